@@ -30,6 +30,7 @@ import (
 	"io"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
 	"strings"
 	"sync"
@@ -38,8 +39,13 @@ import (
 
 	"github.com/pkg/errors"
 	logs "github.com/wtsi-npg/logshim"
+	"golang.org/x/text/unicode/norm"
 )
 
+// The baton-do operations. Client methods are limited to these: baton-do has no
+// operation to list resources, replicate or trim data objects, register files
+// or run specific queries, and its list operation reports only the path,
+// checksum, size, ACLs, AVUs, replicates and timestamps of an item.
 const (
 	CHMOD     = "chmod"     // chmod baton operation
 	CHECKSUM  = "checksum"  // checksum baton operation
@@ -50,6 +56,7 @@ const (
 	METAREM   = "rem"       // metamod rem baton operation
 	METAQUERY = "metaquery" // metaquery baton operation
 	MKDIR     = "mkdir"     // mkdir baton operation
+	MOVE      = "move"      // move baton operation
 	PUT       = "put"       // put baton operation
 	REMOVE    = "remove"    // rm baton operation
 	RMDIR     = "rmdir"     // rmdir baton operation
@@ -59,6 +66,8 @@ const (
 	RodsUserFileDoesNotExist  = int32(-310000) // iRODS: user file does not exist
 	RodsCatCollectionNotEmpty = int32(-821000) // iRODS: collection not empty
 	RodsUnixFileReadError     = int32(-512021) // iRODS: failed to read a file
+	RodsCatNoAccessPermission = int32(-818000) // iRODS: no access permission
+	RodsUserChecksumMismatch  = int32(-314000) // iRODS: checksum mismatch
 )
 
 // DefaultResponseTimeout is a timeout for the baton-do sub-process to respond
@@ -66,6 +75,20 @@ const (
 // for example responding after a put operation on 1 TiB of data.
 var DefaultResponseTimeout = 5 * time.Second
 
+// DefaultWriteTimeout is a timeout for the baton-do sub-process to accept a
+// request on its STDIN. baton-do reads each request before acting on it, so a
+// sub-process that fails to do so within this time is assumed to be wedged.
+var DefaultWriteTimeout = 10 * time.Second
+
+// truncatedResponseGrace is the time allowed for the sub-process to be seen to
+// stop after sending an invalid response, for the response to be reported as
+// truncated by termination.
+const truncatedResponseGrace = 500 * time.Millisecond
+
+// DefaultPipelineDepth is the default maximum number of requests that Pipeline
+// sends to the baton-do sub-process before reading a response.
+var DefaultPipelineDepth = 16
+
 // Client is a launcher for a baton sub-process which holds its system I/O
 // streams and its channels. If accessed from more than one goroutine,
 // instances must be externally synchronised.
@@ -78,9 +101,13 @@ type Client struct {
 	in           chan []byte        // For sending to the sub-process.
 	out          chan []byte        // For receiving from the sub-process.
 	err          chan error         // For recording any sub-process error.
+	written      chan error         // For confirming writes to the sub-process.
 	pid          int                // PID of the sub-process.
 	respTimeout  time.Duration      // Timeout for the sub-process to respond.
+	writeTimeout time.Duration      // Timeout for the sub-process to accept input.
 	cancel       context.CancelFunc // For stopping the I/O goroutines.
+	stopOnce     *sync.Once         // For stopping once, once started.
+	stopErr      error              // Any error from the sub-process on stopping.
 	inWaitGroup  *sync.WaitGroup    // WaitGroup for STDIN goroutine.
 	outWaitGroup *sync.WaitGroup    // WaitGroup for STDOUT/STDERR goroutines.
 	sync.RWMutex
@@ -88,6 +115,13 @@ type Client struct {
 	startTime    time.Time // Time at which the sub-process was started.
 	stopTime     time.Time // Time at which the sub-process completed.
 	activityTime time.Time // Time of the last activity. Updated by execute().
+	numOps       uint64    // Number of operations requested. Updated by execute().
+	unsorted     bool      // If true, results are left in the order returned.
+	noPgid       bool      // If true, the sub-process is not in its own group.
+	lastID       uint64    // The last request ID issued.
+	workColl     string    // Working collection for relative paths.
+	depth        int       // Maximum requests in flight in a pipeline.
+	normalise    bool      // If true, iRODS paths and AVUs are sent as NFC.
 }
 
 // Envelope is the JSON document accepted by baton-do, describing an operation
@@ -101,6 +135,10 @@ type Envelope struct {
 	Arguments Args `json:"arguments"`
 	// Target of the operation.
 	Target RodsItem `json:"target"`
+	// ID of the request, unique within a client and increasing with each
+	// request sent. It is echoed in the response if baton-do supports doing
+	// so; otherwise, responses are matched to requests by their order.
+	ID uint64 `json:"id,omitempty"`
 	// Result of the operation.
 	Result *ResultWrapper `json:"result,omitempty"`
 	// ErrorMsg from the operation.
@@ -109,8 +147,11 @@ type Envelope struct {
 
 // Args contains the arguments for the various baton-do operation parameters.
 type Args struct {
-	// Request an operation.
+	// Sub-operation of a metamod operation, METAADD or METAREM. It is set by
+	// MetaAdd and MetaRem and is not permitted for other operations.
 	Operation string `json:"operation,omitempty"`
+	// Destination path of an operation.
+	Path string `json:"path,omitempty"`
 	// Request ACLs.
 	ACL bool `json:"acl,omitempty"`
 	// Request metadata AVUs.
@@ -135,6 +176,18 @@ type Args struct {
 	Size bool `json:"size,omitempty"`
 	// Request timestamps.
 	Timestamp bool `json:"timestamp,omitempty"`
+
+	// Require that query AVU units match those on results. This is applied
+	// by extendo, rather than baton-do, so it is not sent to the server.
+	MatchUnits bool `json:"-"`
+	// Create empty collections for empty local directories when putting
+	// recursively. This is applied by extendo, rather than baton-do, so it is
+	// not sent to the server.
+	EmptyDirs bool `json:"-"`
+	// Limit the depth of a recursive list to this many levels below the listed
+	// collection, 0 for no limit. This is applied by extendo, rather than
+	// baton-do, so it is not sent to the server.
+	MaxDepth int `json:"-"`
 }
 
 // ResultWrapper allows handling of both single results and lists of results in
@@ -166,6 +219,34 @@ func (e *RodsError) Code() int32 {
 	return e.code
 }
 
+// ProtocolError is an error in communication with baton-do, such as a
+// response that is not valid JSON or that has no result. It is distinct from a
+// RodsError, which is a valid response reporting that iRODS refused a request.
+type ProtocolError struct {
+	err error
+}
+
+// Error implements the error interface for ProtocolErrors.
+func (e *ProtocolError) Error() string {
+	return e.err.Error()
+}
+
+// Unwrap returns the underlying error, which may wrap e.g. a JSON syntax
+// error.
+func (e *ProtocolError) Unwrap() error {
+	return e.err
+}
+
+// IsProtocolError returns true if the Cause of the error is a ProtocolError.
+func IsProtocolError(err error) bool {
+	switch errors.Cause(err).(type) {
+	case *ProtocolError:
+		return true
+	default:
+		return false
+	}
+}
+
 // IsRodsError returns true if the Cause of the error is a RodsError.
 func IsRodsError(err error) bool {
 	switch errors.Cause(err).(type) {
@@ -189,34 +270,42 @@ func RodsErrorCode(err error) (int32, error) {
 }
 
 // FindBaton returns the cleaned path to the first occurrence of the baton-do
-// executable in the environment's PATH. If the executable is not found, an
-// error is raised.
+// executable in the environment's PATH. As for the shell, an empty element of
+// PATH means the current working directory. If the environment variable
+// BATON_DO is set, it is used as the path to the executable instead of
+// searching PATH. If the executable is not found, an error is raised.
 func FindBaton() (string, error) {
-	var baton string
-	var err error
+	if override := os.Getenv("BATON_DO"); override != "" {
+		if !isExecutableFile(override) {
+			return "", errors.Errorf("BATON_DO '%s' is not an executable "+
+				"file", override)
+		}
+		return filepath.Abs(override)
+	}
 
 	envPath := os.Getenv("PATH")
-	dirs := strings.Split(envPath, ":")
+	if envPath == "" {
+		return "", errors.New("baton-do cannot be found because PATH is " +
+			"empty or unset; set PATH, or set BATON_DO to the path of baton-do")
+	}
 
-	for _, dir := range dirs {
-		paths, err := filepath.Glob(filepath.Join(dir, "baton-do"))
-		if err != nil {
-			break
+	for _, dir := range filepath.SplitList(envPath) {
+		if dir == "" {
+			dir = "."
 		}
 
-		for _, path := range paths {
-			if filepath.Base(path) == "baton-do" {
-				baton = path
-				break
-			}
+		path := filepath.Join(dir, "baton-do")
+		if isExecutableFile(path) {
+			return filepath.Abs(path)
 		}
 	}
-	if baton == "" {
-		return baton, errors.Errorf("baton-do not present in PATH '%s'",
-			envPath)
-	}
 
-	return filepath.Clean(baton), err
+	return "", errors.Errorf("baton-do not present in PATH '%s'", envPath)
+}
+
+func isExecutableFile(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.Mode().IsRegular() && info.Mode().Perm()&0111 != 0
 }
 
 // BatonVersion reports the version string printed by baton-do --version
@@ -298,7 +387,9 @@ func (client *Client) Start(arg ...string) (*Client, error) {
 	// Start in its own process group. This allows a more graceful shutdown
 	// when stopped with ^C in the shell. The baton-do process won't get the
 	// SIGINT and will be stopped by the parent process.
-	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true, Pgid: 0}
+	if !client.noPgid {
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true, Pgid: 0}
+	}
 
 	if err = cmd.Start(); err != nil {
 		return nil, err
@@ -308,6 +399,7 @@ func (client *Client) Start(arg ...string) (*Client, error) {
 	pin := make(chan []byte)
 	pout := make(chan []byte)
 	perr := make(chan error, 1)
+	pwritten := make(chan error, 1)
 
 	// I/O goroutine cancelling and cleanup
 	cancelCtx, cancel := context.WithCancel(context.Background())
@@ -338,6 +430,7 @@ func (client *Client) Start(arg ...string) (*Client, error) {
 						Int("num_written", n).
 						Msg("error writing to stdin")
 				}
+				pwritten <- werr
 			}
 		}
 	}(cancelCtx)
@@ -361,6 +454,15 @@ func (client *Client) Start(arg ...string) (*Client, error) {
 				} else if errors.Is(re, io.EOF) {
 					log.Debug().Str("executable", client.path).
 						Msg("reached EOF on stdout")
+
+					// Pass on any partial final line, such as a response
+					// truncated by the sub-process terminating
+					if partial := bytes.TrimRight(bout, "\r\n"); len(partial) > 0 {
+						select {
+						case pout <- partial:
+						case <-ctx.Done():
+						}
+					}
 					return
 				} else {
 					log.Error().Err(re).Str("executable", client.path).
@@ -409,11 +511,15 @@ func (client *Client) Start(arg ...string) (*Client, error) {
 	client.in = pin
 	client.out = pout
 	client.err = perr
+	client.written = pwritten
 	client.pid = cmd.Process.Pid
 	client.isRunning = true
 	client.startTime = time.Now()
 	client.respTimeout = DefaultResponseTimeout
+	client.writeTimeout = DefaultWriteTimeout
 	client.cancel = cancel
+	client.stopOnce = &sync.Once{}
+	client.stopErr = nil
 	client.inWaitGroup = &inWg
 	client.outWaitGroup = &outWg
 
@@ -437,11 +543,24 @@ func (client *Client) Start(arg ...string) (*Client, error) {
 }
 
 // Stop stops the baton sub-process, if it is running. Returns any error
-// from the sub-process.
+// from the sub-process. It is safe to call Stop more than once; later calls
+// return the same result as the first. Calling Stop on a client that was never
+// started does nothing.
 func (client *Client) Stop() error {
-	client.cancel()
+	client.RLock()
+	once := client.stopOnce
+	client.RUnlock()
+
+	if once == nil {
+		return nil
+	}
+
+	once.Do(func() {
+		client.cancel()
+		client.stopErr = <-client.err
+	})
 
-	return <-client.err
+	return client.stopErr
 }
 
 // IdleTime returns the duration for which the client has been idle (time
@@ -457,6 +576,15 @@ func (client *Client) IdleTime() time.Duration {
 	return client.stopTime.Sub(client.activityTime)
 }
 
+// LastActivity returns the time at which the client last sent a request to the
+// sub-process, or the zero time if it has sent none.
+func (client *Client) LastActivity() time.Time {
+	client.RLock()
+	defer client.RUnlock()
+
+	return client.activityTime
+}
+
 // Runtime returns the duration for which the client has run. If the client is
 // running, it reports time spent so far. If the client has been stopped, it
 // reports the duration for which it ran.
@@ -470,15 +598,229 @@ func (client *Client) Runtime() time.Duration {
 	return client.stopTime.Sub(client.startTime)
 }
 
+// OperationCount returns the number of operations the client has been asked to
+// perform since it was created. This includes operations that failed.
+func (client *Client) OperationCount() uint64 {
+	client.RLock()
+	defer client.RUnlock()
+
+	return client.numOps
+}
+
+// SetSortResults sets whether the client sorts the results of operations. By
+// default, results are sorted, as are each result's contents, replicates, AVUs,
+// ACLs and timestamps. This gives a deterministic order, at some cost for large
+// results. If sorting is disabled, results are left in the order returned by
+// baton-do, which is not guaranteed to be stable.
+func (client *Client) SetSortResults(sort bool) {
+	client.Lock()
+	defer client.Unlock()
+
+	client.unsorted = !sort
+}
+
+// SortResults returns true if the client sorts the results of operations.
+func (client *Client) SortResults() bool {
+	client.RLock()
+	defer client.RUnlock()
+
+	return !client.unsorted
+}
+
+// SetProcessGroup sets whether the client starts its baton-do sub-process in
+// a new process group. By default, it does, so that the sub-process does not
+// receive a SIGINT sent to the parent's process group e.g. by ^C in the shell,
+// and is instead stopped gracefully by the parent. Some supervisors and
+// debuggers expect to signal all the processes they started through their
+// process group; disabling this allows them to do so, at the cost of a ^C
+// interrupting baton-do directly, possibly part way through an operation. It
+// must be called before Start to have any effect.
+func (client *Client) SetProcessGroup(pgid bool) {
+	client.Lock()
+	defer client.Unlock()
+
+	client.noPgid = !pgid
+}
+
+// SetWorkingCollection sets the collection against which relative iRODS paths
+// of items are resolved, in the manner of a current working directory. baton-do
+// has no working collection, so this is applied by the client before sending
+// each operation. The path must be absolute. Setting the empty string unsets
+// the working collection, after which relative paths are sent unchanged. A
+// relative path whose ".." elements leave the zone of the working collection
+// is an error.
+func (client *Client) SetWorkingCollection(remotePath string) error {
+	if remotePath != "" && !strings.HasPrefix(remotePath, "/") {
+		return errors.Errorf("invalid working collection '%s': the path "+
+			"must be absolute", remotePath)
+	}
+	if remotePath != "" {
+		remotePath = path.Clean(remotePath)
+	}
+
+	client.Lock()
+	defer client.Unlock()
+
+	client.workColl = remotePath
+	return nil
+}
+
+// WorkingCollection returns the working collection of the client, or the empty
+// string if none has been set.
+func (client *Client) WorkingCollection() string {
+	client.RLock()
+	defer client.RUnlock()
+
+	return client.workColl
+}
+
+// SetNormaliseUnicode sets whether the client normalises the iRODS paths and
+// the metadata of items to Unicode Normalization Form C (NFC) before sending
+// each operation. iRODS compares names as bytes, so a name composed in NFC does
+// not match the same name decomposed in NFD, as made by some macOS
+// applications. By default, paths and metadata are sent unchanged. When
+// enabled, the working collection is also normalised, as are the arguments
+// that the client compares with results itself e.g. the query AVUs of
+// MetaQuery with Args.MatchUnits and the AVUs given to the RodsItem metadata
+// methods. Local paths are never normalised, because they must match the
+// local filesystem.
+func (client *Client) SetNormaliseUnicode(normalise bool) {
+	client.Lock()
+	defer client.Unlock()
+
+	client.normalise = normalise
+}
+
+// NormaliseUnicode returns true if the client normalises iRODS paths and
+// metadata to NFC.
+func (client *Client) NormaliseUnicode() bool {
+	client.RLock()
+	defer client.RUnlock()
+
+	return client.normalise
+}
+
+// normaliseNFC returns the arguments and item with their iRODS paths and AVUs
+// normalised to NFC. The item's AVUs are copied, rather than modified in
+// place.
+func normaliseNFC(args Args, item RodsItem) (Args, RodsItem) {
+	args.Path = norm.NFC.String(args.Path)
+	item.IPath = norm.NFC.String(item.IPath)
+	item.IName = norm.NFC.String(item.IName)
+
+	if item.IAVUs != nil {
+		avus := make([]AVU, len(item.IAVUs))
+		for i, avu := range item.IAVUs {
+			avu.Attr = norm.NFC.String(avu.Attr)
+			avu.Value = norm.NFC.String(avu.Value)
+			avu.Units = norm.NFC.String(avu.Units)
+			avus[i] = avu
+		}
+		item.IAVUs = avus
+	}
+
+	return args, item
+}
+
+// normaliseAVUs returns the AVUs normalised to NFC, if the client normalises
+// Unicode, or otherwise the AVUs unchanged. The client may be nil.
+func (client *Client) normaliseAVUs(avus []AVU) []AVU {
+	if client == nil || !client.NormaliseUnicode() {
+		return avus
+	}
+	_, item := normaliseNFC(Args{}, RodsItem{IAVUs: avus})
+
+	return item.IAVUs
+}
+
+// resolve returns the arguments and item with any relative iRODS paths
+// resolved against the working collection, if one is set, and then with their
+// iRODS paths, including the working collection, and AVUs normalised to NFC,
+// if the client normalises Unicode. A relative path whose ".." elements leave
+// the zone of the working collection is an error. Resolving is idempotent, so
+// methods that compare their arguments with results on the client side resolve
+// them on entry, as well as when they are sent.
+func (client *Client) resolve(args Args, item RodsItem) (Args, RodsItem,
+	error) {
+	if client == nil {
+		return args, item, nil
+	}
+
+	workColl := client.WorkingCollection()
+	if workColl != "" {
+		var err error
+		if item.IPath, err = resolvePath(workColl, item.IPath); err != nil {
+			return args, item, err
+		}
+		if args.Path, err = resolvePath(workColl, args.Path); err != nil {
+			return args, item, err
+		}
+	}
+
+	if client.NormaliseUnicode() {
+		args, item = normaliseNFC(args, item)
+	}
+
+	return args, item, nil
+}
+
+// resolvePath returns p joined to the working collection workColl, if p is a
+// relative path. The zone is checked before joining, because joining cleans
+// away the ".." elements that would leave it.
+func resolvePath(workColl string, p string) (string, error) {
+	if p == "" || strings.HasPrefix(p, "/") {
+		return p, nil
+	}
+	if leavesZone(workColl + "/" + p) {
+		return p, errors.Errorf("relative path '%s' leaves the zone of "+
+			"the working collection '%s'", p, workColl)
+	}
+
+	return path.Join(workColl, p), nil
+}
+
+// SetPipelineDepth sets the maximum number of requests that Pipeline sends to
+// the baton-do sub-process before reading a response. A depth of 1 is
+// equivalent to sending the requests one at a time. Greater depths use more
+// pipe buffer space; if baton-do fills its output buffer while the client is
+// not reading, it stops accepting requests and a write timeout may occur.
+func (client *Client) SetPipelineDepth(depth int) {
+	client.Lock()
+	defer client.Unlock()
+
+	client.depth = depth
+}
+
+// PipelineDepth returns the maximum number of requests that Pipeline sends
+// before reading a response.
+func (client *Client) PipelineDepth() int {
+	client.RLock()
+	defer client.RUnlock()
+
+	if client.depth < 1 {
+		return DefaultPipelineDepth
+	}
+	return client.depth
+}
+
 // StopIgnoreError stops the baton sub-process, if it is running. Ignores any
-// error from the sub-process.
+// error from the sub-process, other than logging it. Nothing is logged if the
+// sub-process stops cleanly.
 func (client *Client) StopIgnoreError() {
+	pid := client.ClientPid()
 	if err := client.Stop(); err != nil {
-		logs.GetLogger().Error().Err(err).Int("pid", client.ClientPid()).
-			Msg("stopped client")
+		logs.GetLogger().Error().Err(err).Int("pid", pid).
+			Msg("client did not stop cleanly")
 	}
 }
 
+// StopQuietly stops the baton sub-process, if it is running. Ignores any
+// error from the sub-process without logging it. This is intended for
+// teardown where an error is expected or of no interest.
+func (client *Client) StopQuietly() {
+	_ = client.Stop()
+}
+
 // ClientPid returns the process ID of the baton sub-process if it has started,
 // or -1 otherwise.
 func (client *Client) ClientPid() int {
@@ -499,6 +841,58 @@ func (client *Client) IsRunning() bool {
 	return client.isRunning
 }
 
+// UserInfo describes the iRODS user of a client, as configured in the iRODS
+// environment file used by baton-do.
+type UserInfo struct {
+	User string `json:"irods_user_name"` // iRODS user name
+	Zone string `json:"irods_zone_name"` // iRODS zone name
+}
+
+// UserInfo returns the iRODS user and zone of the client. baton-do has no
+// operation to report these, so they are read from the iRODS environment file
+// that it uses: the file named by the IRODS_ENVIRONMENT_FILE environment
+// variable, or ~/.irods/irods_environment.json by default.
+func (client *Client) UserInfo() (UserInfo, error) {
+	var info UserInfo
+
+	path := os.Getenv("IRODS_ENVIRONMENT_FILE")
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return info, err
+		}
+		path = filepath.Join(home, ".irods", "irods_environment.json")
+	}
+
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return info, errors.Wrap(err, "failed to read the iRODS environment")
+	}
+	if err = json.Unmarshal(buf, &info); err != nil {
+		return info, errors.Wrapf(err, "invalid iRODS environment file '%s'",
+			path)
+	}
+	if info.User == "" || info.Zone == "" {
+		return info, errors.Errorf("iRODS environment file '%s' does not "+
+			"set both irods_user_name and irods_zone_name", path)
+	}
+
+	return info, err
+}
+
+// HomeCollection returns the home collection of the client's iRODS user,
+// /<zone>/home/<user>, as given by UserInfo. The collection is not checked
+// for existence.
+func (client *Client) HomeCollection() (*Collection, error) {
+	info, err := client.UserInfo()
+	if err != nil {
+		return nil, err
+	}
+
+	return NewCollection(client, filepath.Join("/", info.Zone, "home",
+		info.User)), err
+}
+
 // Chmod sets permissions on a collection or data object in iRODS. By setting
 // Args.Recurse=true, the operation may be made recursive.
 func (client *Client) Chmod(args Args, item RodsItem) (RodsItem, error) {
@@ -509,6 +903,106 @@ func (client *Client) Chmod(args Args, item RodsItem) (RodsItem, error) {
 	return items[0], err
 }
 
+// ChmodRecurse sets permissions on a collection and on everything within it,
+// as for Chmod with Args.Recurse=true. baton does not report which items were
+// changed, so afterwards the items are listed to verify that the permissions
+// were applied. It returns the paths of the items that carry the permissions.
+// If any item does not, an error is returned, which names one such item and
+// reports how many there were. Inheritance pseudo-ACLs are applied, but
+// cannot be verified.
+func (client *Client) ChmodRecurse(item RodsItem) ([]string, error) {
+	if _, err := client.Chmod(Args{Recurse: true}, item); err != nil {
+		return nil, err
+	}
+
+	root, err := client.ListItem(Args{ACL: true}, item)
+	if err != nil {
+		return nil, err
+	}
+	items, err := client.List(Args{ACL: true, Recurse: true}, item)
+	if err != nil {
+		return nil, err
+	}
+
+	var applied, notApplied []string
+	for _, it := range items {
+		// The recursive listing does not include the root's ACLs
+		if it.RodsPath() == root.RodsPath() {
+			it = root
+		}
+
+		if aclsApplied(it.IACLs, item.IACLs) {
+			applied = append(applied, it.RodsPath())
+		} else {
+			notApplied = append(notApplied, it.RodsPath())
+		}
+	}
+
+	if len(notApplied) > 0 {
+		return applied, errors.Errorf("recursive chmod of %s was not applied "+
+			"to %d of %d items, including %s", item.RodsPath(),
+			len(notApplied), len(items), notApplied[0])
+	}
+
+	return applied, err
+}
+
+// CopyACLs reads the ACLs of the item from and applies them to the item to, so
+// that to grants at least the access that from does. Any ACLs of to that from
+// does not have are not removed. Collection ACL inheritance is not copied
+// because baton does not report it.
+func (client *Client) CopyACLs(from RodsItem, to RodsItem) error {
+	src, err := client.ListItem(Args{ACL: true}, from)
+	if err != nil {
+		return err
+	}
+	if len(src.IACLs) == 0 {
+		return nil
+	}
+
+	dst := CopyRodsItem(to)
+	dst.IACLs = src.IACLs
+	_, err = client.Chmod(Args{}, dst)
+
+	return err
+}
+
+// aclsApplied returns true if the ACLs of an item (have) reflect the result of
+// applying the requested ACLs (want). A requested ACL at the "null" level
+// requires the absence of any access for its owner. A requested ACL with no
+// zone matches any zone. Inheritance pseudo-ACLs are ignored.
+func aclsApplied(have []ACL, want []ACL) bool {
+	matches := func(w ACL, h ACL) bool {
+		return w.Owner == h.Owner && (w.Zone == "" || w.Zone == h.Zone)
+	}
+
+	for _, w := range want {
+		switch w.Level {
+		case ACLInherit, ACLNoInherit:
+			continue
+		case ACLNull:
+			for _, h := range have {
+				if matches(w, h) {
+					return false
+				}
+			}
+		default:
+			found := false
+			for _, h := range have {
+				if matches(w, h) && w.Level == h.Level {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
 // Checksum calculates a checksum for a data object in iRODS. iRODS makes this
 // a no-op if a checksum is already recorded. However, this can be overridden
 // by setting Force=true in Args. When called, this sets or updates the checksum
@@ -535,30 +1029,154 @@ func (client *Client) Get(args Args, item RodsItem) (RodsItem, error) {
 
 // List retrieves information about collections and/or data objects in iRODS.
 // The items returned are sorted (collections first, then by path and finally
-// by name). The detailed composition of the items is influenced by the
-// supplied Args:
+// by name), unless sorting has been disabled with SetSortResults. The detailed
+// composition of the items is influenced by the supplied Args:
 //
 // Args.ACL = true        Include ACLs
 // Args.AVU = true        Include AVUs
 // Args.Contents = true   Include collection direct contents
 // Args.Recurse = true    Recurse into collections
+// Args.MaxDepth = n      Recurse at most n levels into collections
 // Args.Replicates = true Include replicates for data objects
 // Args.Size = true       Include size for data objects
 // Args.Timestamp = true  Include timestamps for data objects
 //
 func (client *Client) List(args Args, item RodsItem) ([]RodsItem, error) {
 	if args.Recurse {
-		return client.listRecurse(args, item)
+		return client.listRecurse(args, item, nil)
 	}
 
 	return client.execute(LIST, args, item)
 }
 
+// ListFailure describes a collection whose contents could not be listed.
+type ListFailure struct {
+	Path string // The path of the collection.
+	Err  error  // The error listing the collection.
+}
+
+// ListTolerant retrieves information about a collection in iRODS and everything
+// within it, recursively, as for List with Args.Recurse = true, except that a
+// failure to list the contents of a collection within it (e.g. because it is
+// inaccessible) does not cause the whole list to fail. Such collections and
+// their contents are omitted from the items returned and are reported instead
+// by the returned ListFailures. An error is returned only if the item itself
+// cannot be listed.
+func (client *Client) ListTolerant(args Args, item RodsItem) ([]RodsItem,
+	[]ListFailure, error) {
+	args.Recurse = true
+
+	failures := []ListFailure{}
+	items, err := client.listRecurse(args, item, &failures)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return items, failures, err
+}
+
+// ListCollections retrieves information about collections in iRODS, as for
+// List, but returns only the collections.
+func (client *Client) ListCollections(args Args, item RodsItem) ([]RodsItem, error) {
+	return client.listFiltered(args, item, func(it RodsItem) bool {
+		return it.IsCollection()
+	})
+}
+
+// ListDataObjects retrieves information about data objects in iRODS, as for
+// List, but returns only the data objects.
+func (client *Client) ListDataObjects(args Args, item RodsItem) ([]RodsItem, error) {
+	return client.listFiltered(args, item, func(it RodsItem) bool {
+		return it.IsDataObject()
+	})
+}
+
+func (client *Client) listFiltered(args Args, item RodsItem,
+	pred func(it RodsItem) bool) ([]RodsItem, error) {
+	items, err := client.List(args, item)
+	if err != nil {
+		return items, err
+	}
+
+	var match []RodsItem
+	for _, it := range items {
+		if pred(it) {
+			match = append(match, it)
+		}
+	}
+
+	return match, err
+}
+
+// CollNode is a node in a tree of collections and data objects, as returned by
+// ListTree.
+type CollNode struct {
+	Collection  RodsItem    // The collection.
+	Collections []*CollNode // Sub-collections, sorted by path.
+	DataObjects []RodsItem  // Data objects within the collection, sorted by name.
+}
+
+// ListTree retrieves information about a collection in iRODS and everything
+// within it, recursively, as for List with Args.Recurse = true. Rather than a
+// flat slice, the results are returned as a tree of CollNodes, rooted at the
+// collection, that has the same hierarchy as the collections in iRODS. The
+// effects of Args are the same as for List.
+func (client *Client) ListTree(args Args, item RodsItem) (*CollNode, error) {
+	if !item.IsCollection() {
+		return nil, errors.Errorf("cannot list a tree from '%s' because it "+
+			"is not a collection", item.String())
+	}
+
+	args.Recurse = true
+	items, err := client.List(args, item)
+	if err != nil {
+		return nil, err
+	}
+
+	return buildTree(items)
+}
+
+// buildTree returns a tree of the items, rooted at the collection that
+// contains all the others.
+func buildTree(items []RodsItem) (*CollNode, error) {
+	SortRodsItems(items)
+
+	if len(items) == 0 || !items[0].IsCollection() {
+		return nil, errors.New("no root collection for the tree")
+	}
+
+	root := &CollNode{Collection: items[0]}
+	nodes := map[string]*CollNode{root.Collection.RodsPath(): root}
+
+	// Sorting places collections before data objects and each collection
+	// before its sub-collections, so parents are always seen first
+	for _, item := range items[1:] {
+		p := item.RodsPath()
+		parent, ok := nodes[filepath.Dir(p)]
+		if !ok {
+			return nil, errors.Errorf("'%s' is not within the root "+
+				"collection '%s'", p, root.Collection.RodsPath())
+		}
+
+		if item.IsCollection() {
+			node := &CollNode{Collection: item}
+			parent.Collections = append(parent.Collections, node)
+			nodes[p] = node
+		} else {
+			parent.DataObjects = append(parent.DataObjects, item)
+		}
+	}
+
+	return root, nil
+}
+
 // ListItem retrieves information about an individual collection or data
 // object in iRODS. The effects of Args are the same as for List, except that
 // Recurse is not permitted. If the listed item does not exist, an error is
 // returned. If the operation would return more than one collection or data
-// object, an error is returned.
+// object, an error is returned. A data object path identifies exactly one
+// data object, so if more than one item is returned for a data object, it is
+// reported as a ProtocolError.
 func (client *Client) ListItem(args Args, item RodsItem) (RodsItem, error) {
 	if args.Recurse {
 		return item, errors.New("invalid argument: Recurse=true")
@@ -575,13 +1193,50 @@ func (client *Client) ListItem(args Args, item RodsItem) (RodsItem, error) {
 	case 1:
 		return items[0], err
 	default:
+		if item.IsDataObject() {
+			return item, &ProtocolError{errors.Errorf("%d items were "+
+				"returned for the single data object '%s', indicating a "+
+				"server anomaly: %+v", len(items), item.RodsPath(), items)}
+		}
 		return item, errors.Errorf("attempt to ListItem multiple "+
 			"items: %+v", items)
 	}
 }
 
+// ItemFromPath returns a RodsItem for the collection or data object at
+// remotePath, deciding which by listing the path in iRODS. The returned item
+// uses this client. If nothing exists at the path, an error is returned.
+func (client *Client) ItemFromPath(remotePath string) (RodsItem, error) {
+	item, err := client.ListItem(Args{}, RodsItem{IPath: filepath.Clean(remotePath)})
+	if err != nil {
+		return item, err
+	}
+	item.client = client
+
+	return item, err
+}
+
+// Describe returns a complete snapshot of an item, listed with its ACLs, AVUs
+// and, for a data object, its checksum, size, replicates and timestamps, in a
+// single request. This is intended for diagnostics and tools that report on
+// items, where the cost of fetching every detail is acceptable. The returned
+// item uses this client.
+func (client *Client) Describe(item RodsItem) (RodsItem, error) {
+	args := Args{ACL: true, AVU: true, Checksum: true, Replicate: true,
+		Size: true, Timestamp: true}
+	it, err := client.ListItem(args, item)
+	if err != nil {
+		return it, err
+	}
+	it.client = client
+
+	return it, err
+}
+
 // ListChecksum returns the iRODS checksum of an item, which must be a data
-// object.
+// object. If the data object exists, but has no checksum, the empty string is
+// returned. If the data object does not exist, an error is returned saying so,
+// whose cause is the iRODS error.
 func (client *Client) ListChecksum(item RodsItem) (string, error) {
 	var checksum string
 
@@ -592,6 +1247,12 @@ func (client *Client) ListChecksum(item RodsItem) (string, error) {
 
 	obj, err := client.ListItem(Args{Checksum: true}, item)
 	if err != nil {
+		if code, cerr := RodsErrorCode(err); cerr == nil &&
+			code == RodsUserFileDoesNotExist {
+			return checksum, errors.Wrapf(err, "failed to read the checksum "+
+				"of %s because the data object does not exist",
+				item.RodsPath())
+		}
 		return checksum, err
 	}
 	checksum = obj.IChecksum
@@ -599,6 +1260,36 @@ func (client *Client) ListChecksum(item RodsItem) (string, error) {
 	return checksum, err
 }
 
+// VerifyObjectChecksum fetches the checksum stored for a data object in iRODS
+// and then has iRODS recompute the checksum from the data. It returns true if
+// they match, along with the stored and recomputed checksums. A mismatch
+// indicates corruption of the data, or a stale stored checksum, and is returned
+// as an error giving both checksums. The recomputed checksum replaces the
+// stored checksum in iRODS, so the error is the remaining record of the
+// stored value.
+func (client *Client) VerifyObjectChecksum(item RodsItem) (bool, string,
+	string, error) {
+	stored, err := client.ListChecksum(item)
+	if err != nil {
+		return false, "", "", err
+	}
+
+	obj, err := client.Checksum(Args{Checksum: true, Force: true}, item)
+	if err != nil {
+		return false, stored, "", err
+	}
+	recomputed := obj.IChecksum
+
+	if stored != recomputed {
+		return false, stored, recomputed, errors.Errorf("checksum mismatch "+
+			"for %s: stored checksum '%s' does not match checksum '%s' "+
+			"recomputed from the data, which has replaced it in iRODS",
+			item.RodsPath(), stored, recomputed)
+	}
+
+	return true, stored, recomputed, err
+}
+
 func (client *Client) metaMod(args Args, item RodsItem) (RodsItem, error) {
 	items, err := client.execute(METAMOD, args, item)
 	if err != nil {
@@ -608,8 +1299,15 @@ func (client *Client) metaMod(args Args, item RodsItem) (RodsItem, error) {
 }
 
 // MetaAdd adds the AVUs of the item to a collection or data object in iRODS
-// and returns the item.
+// and returns the item. If any of the AVUs is invalid (see AVU.Validate), an
+// error is returned and none are added.
 func (client *Client) MetaAdd(args Args, item RodsItem) (RodsItem, error) {
+	for _, avu := range item.IAVUs {
+		if err := avu.Validate(); err != nil {
+			return item, err
+		}
+	}
+
 	args.Operation = METAADD
 	return client.metaMod(args, item)
 }
@@ -626,36 +1324,254 @@ func (client *Client) MetaRem(args Args, item RodsItem) (RodsItem, error) {
 // Args.Collection = true (for collections). The iRODS zone for the query may
 // be set by providing a root iRODS path in the RodsItem to act as a zone hint.
 // e.g. RodsItem.IPath = "/seq".
+//
+// The iRODS server ignores AVU units when matching a query. By setting
+// Args.MatchUnits = true, results are additionally filtered so that only
+// items having, for every query AVU, an AVU with the same attribute and units
+// are returned. Query AVUs with an empty Units match only AVUs without units.
 func (client *Client) MetaQuery(args Args, item RodsItem) ([]RodsItem, error) {
 	if !(args.Object || args.Collection) {
 		return nil, errors.Errorf("metaquery arguments must specify " +
 			"Object and/or Collection targets; neither were specified")
 	}
+	args, item, err := client.resolve(args, item)
+	if err != nil {
+		return nil, err
+	}
 
-	return client.execute(METAQUERY, args, item)
-}
+	if !args.MatchUnits {
+		return client.execute(METAQUERY, args, item)
+	}
 
-// MkDir creates a new collection in iRODS and returns the item.
-func (client *Client) MkDir(args Args, item RodsItem) (RodsItem, error) {
-	items, err := client.execute(MKDIR, args, item)
+	// AVUs are required on the results in order to compare units
+	wantAVUs := args.AVU
+	args.AVU = true
+
+	items, err := client.execute(METAQUERY, args, item)
 	if err != nil {
-		return item, err
+		return items, err
+	}
+
+	items = filterByUnits(items, item.IAVUs)
+	if !wantAVUs {
+		for i := range items {
+			items[i].IAVUs = nil
+		}
+	}
+
+	return items, err
+}
+
+// MkDir creates a new collection in iRODS and returns the item.
+func (client *Client) MkDir(args Args, item RodsItem) (RodsItem, error) {
+	items, err := client.execute(MKDIR, args, item)
+	if err != nil {
+		return item, err
+	}
+	return items[0], err
+}
+
+// Move moves (renames) a collection or data object in iRODS to the path given
+// by Args.Path and returns the item.
+func (client *Client) Move(args Args, item RodsItem) (RodsItem, error) {
+	if args.Path == "" {
+		return item, errors.New("invalid argument: Path was empty")
+	}
+
+	items, err := client.execute(MOVE, args, item)
+	if err != nil {
+		return item, err
 	}
 	return items[0], err
 }
 
 // Put a collection or data object into iRODS and returns the item. By
 // setting Args.Recurse=true, the operation may be made recursive on a
-// collection.
+// collection. A recursive put creates only those collections that are needed
+// to hold data objects, unless Args.EmptyDirs=true, in which case each empty
+// local directory is mirrored by an empty collection and included in the
+// returned items.
 func (client *Client) Put(args Args, item RodsItem) ([]RodsItem, error) {
+	return client.PutContext(context.Background(), args, item)
+}
+
+// PutContext puts a collection or data object into iRODS, as for Put, until
+// ctx is done. A recursive put checks ctx before creating each collection and
+// before putting each data object. If ctx is done, the put stops and returns
+// the items already transferred, with the error from ctx.
+func (client *Client) PutContext(ctx context.Context, args Args,
+	item RodsItem) ([]RodsItem, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
 	if args.Recurse {
-		return client.putRecurse(args, item)
+		return client.putRecurse(ctx, args, item)
 	}
 
 	return client.execute(PUT, args, item)
 }
 
-// RemObj removes a data object from iRODS and returns the item.
+// Operation describes a baton-do operation to be sent by Pipeline.
+type Operation struct {
+	Operation string   // A baton-do operation e.g. LIST.
+	Args      Args     // Arguments of the operation.
+	Target    RodsItem // Target of the operation.
+}
+
+// OperationResult is the outcome of an Operation sent by Pipeline.
+type OperationResult struct {
+	Items []RodsItem // Items returned by the operation, if successful.
+	Err   error      // Error from the operation, if unsuccessful.
+}
+
+// Pipeline sends operations to the baton-do sub-process without waiting for
+// the response to each before sending the next, up to the client's pipeline
+// depth (see SetPipelineDepth). This improves throughput for many small
+// operations, such as listing or adding metadata to many items. Each request
+// carries an ID, by which the responses are matched to the operations. The
+// results are returned in the order of the operations.
+//
+// The operations are sent as they are, without the additional processing done
+// by the Client methods for each operation (e.g. Args.MatchUnits is ignored).
+// An operation that fails has its error in its result. If communication with
+// baton-do fails, the results so far and the error are returned.
+func (client *Client) Pipeline(ops []Operation) ([]OperationResult, error) {
+	results := make([]OperationResult, len(ops))
+
+	depth := 1
+	if client != nil {
+		depth = client.PipelineDepth()
+	}
+
+	inFlight := make(map[uint64]int) // Request ID to operation index
+	var order []uint64               // Request IDs, in order sent
+
+	receiveOne := func() error {
+		response, err := client.receive()
+		if err != nil {
+			return err
+		}
+
+		id := response.ID
+		if id == 0 {
+			// baton-do did not echo the ID; it responds in order
+			id = order[0]
+		}
+		i, ok := inFlight[id]
+		if !ok {
+			return &ProtocolError{errors.Errorf("response to %s operation "+
+				"has unknown request ID %d", response.Operation, response.ID)}
+		}
+		delete(inFlight, id)
+		for j := range order {
+			if order[j] == id {
+				order = append(order[:j], order[j+1:]...)
+				break
+			}
+		}
+
+		results[i].Items, results[i].Err = unwrap(client, response)
+		return nil
+	}
+
+	for i, op := range ops {
+		args, target, err := client.resolve(op.Args, op.Target)
+		if err == nil {
+			err = client.begin(op.Operation, args, target)
+		}
+		if err != nil {
+			results[i].Err = err
+			continue
+		}
+
+		for len(inFlight) >= depth {
+			if err := receiveOne(); err != nil {
+				return results, err
+			}
+		}
+
+		envelope := wrap(op.Operation, args, target)
+		if err := client.sendRequest(envelope); err != nil {
+			return results, err
+		}
+		inFlight[envelope.ID] = i
+		order = append(order, envelope.ID)
+	}
+
+	for len(inFlight) > 0 {
+		if err := receiveOne(); err != nil {
+			return results, err
+		}
+	}
+
+	return results, nil
+}
+
+// PutEntry describes a local file to be put into iRODS by PutManifest.
+type PutEntry struct {
+	LocalPath  string // Path of the local file.
+	RemotePath string // Path of the data object in iRODS.
+	Checksum   string // Expected checksum, if any.
+	AVUs       []AVU  // Metadata to add, if any.
+}
+
+// PutManifest puts each entry's local file to its data object in iRODS,
+// creating any leading collections, as for PutDataObject. Where an entry has a
+// checksum, it is compared with that of the new data object and a mismatch is
+// an error. Any AVUs of the entry are then added. The returned items are in the
+// order of the entries and have their checksum and metadata fetched. Failure
+// of an entry does not prevent attempts on the remainder; its item has only the
+// paths of the entry. If any fail, the first error is returned, annotated with
+// the number of failures.
+func (client *Client) PutManifest(entries []PutEntry) ([]RodsItem, error) {
+	items := make([]RodsItem, len(entries))
+
+	var bulk bulkErrors
+	for i, entry := range entries {
+		item, err := client.putEntry(entry)
+		items[i] = item
+		bulk.add(item, err)
+	}
+
+	return items, bulk.err("put")
+}
+
+func (client *Client) putEntry(entry PutEntry) (RodsItem, error) {
+	localPath := filepath.Clean(entry.LocalPath)
+	target := NewDataObject(client, entry.RemotePath)
+	target.IDirectory = filepath.Dir(localPath)
+	target.IFile = filepath.Base(localPath)
+
+	if _, err := client.MkDir(Args{Recurse: true},
+		RodsItem{IPath: target.IPath}); err != nil {
+		return *target.RodsItem, err
+	}
+
+	obj, err := PutDataObject(client, localPath, target.RodsPath())
+	if err != nil {
+		return *target.RodsItem, err
+	}
+
+	if entry.Checksum != "" && obj.Checksum() != entry.Checksum {
+		return *obj.RodsItem, errors.Errorf("failed to put '%s' to '%s': "+
+			"expected checksum '%s' did not match remote checksum '%s'",
+			localPath, obj.RodsPath(), entry.Checksum, obj.Checksum())
+	}
+
+	if len(entry.AVUs) > 0 {
+		if err = obj.AddMetadata(entry.AVUs); err != nil {
+			return *obj.RodsItem, err
+		}
+	}
+
+	return *obj.RodsItem, err
+}
+
+// RemObj removes a data object from iRODS and returns the item. If the iRODS
+// zone has a trash collection, the data object is moved there, from where it
+// may be recovered. By setting Args.Force=true, the trash is bypassed and the
+// data object is removed permanently.
 func (client *Client) RemObj(args Args, item RodsItem) ([]RodsItem, error) {
 	return client.execute(REMOVE, args, item)
 }
@@ -665,9 +1581,189 @@ func (client *Client) RemDir(args Args, item RodsItem) ([]RodsItem, error) {
 	return client.execute(RMDIR, args, item)
 }
 
-func (client *Client) listRecurse(args Args, item RodsItem) ([]RodsItem, error) {
+// RemoveMetadataFromQuery runs a metadata search in iRODS, as for MetaQuery,
+// and removes the argument AVUs from every matching item. Failure to remove
+// AVUs from an item does not prevent attempts on the remainder; if any fail,
+// the first error is returned, annotated with the number of failures. See
+// ClientPool.RemoveMetadataFromQuery for a concurrent version.
+func (client *Client) RemoveMetadataFromQuery(args Args, queryItem RodsItem,
+	avus []AVU) error {
+	items, err := client.MetaQuery(args, queryItem)
+	if err != nil {
+		return err
+	}
+
+	var bulk bulkErrors
+	for _, item := range items {
+		bulk.add(item, removeMetadataFrom(client, item, avus))
+	}
+
+	return bulk.err("remove metadata from")
+}
+
+func removeMetadataFrom(client *Client, item RodsItem, avus []AVU) error {
+	it := CopyRodsItem(item)
+	it.IAVUs = avus
+	_, err := client.MetaRem(Args{}, it)
+	return err
+}
+
+// ChmodQueryResults runs a metadata search in iRODS, as for MetaQuery, and
+// applies the argument ACLs to every matching item e.g. to give a new group
+// access to all the data of a study. Failure to apply the ACLs to an item does
+// not prevent attempts on the remainder; if any fail, the first error is
+// returned, annotated with the number of failures. See
+// ClientPool.ChmodQueryResults for a concurrent version.
+func (client *Client) ChmodQueryResults(args Args, queryItem RodsItem,
+	acls []ACL) error {
+	items, err := client.MetaQuery(args, queryItem)
+	if err != nil {
+		return err
+	}
+
+	var bulk bulkErrors
+	for _, item := range items {
+		bulk.add(item, chmodItem(client, item, acls))
+	}
+
+	return bulk.err("set ACLs on")
+}
+
+func chmodItem(client *Client, item RodsItem, acls []ACL) error {
+	it := CopyRodsItem(item)
+	it.IACLs = acls
+	_, err := client.Chmod(Args{}, it)
+	return err
+}
+
+// bulkErrors records the outcome of an operation applied to many items.
+type bulkErrors struct {
+	sync.Mutex
+	first     error
+	numFailed int
+	numTotal  int
+}
+
+func (b *bulkErrors) add(item RodsItem, err error) {
+	b.Lock()
+	defer b.Unlock()
+
+	b.numTotal++
+	if err == nil {
+		return
+	}
+
+	logs.GetLogger().Error().Err(err).Str("path", item.String()).
+		Msg("bulk operation failed")
+	if b.first == nil {
+		b.first = err
+	}
+	b.numFailed++
+}
+
+// err returns the first error recorded, annotated with the number of failures,
+// or nil if there were none.
+func (b *bulkErrors) err(desc string) error {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.first == nil {
+		return nil
+	}
+	return errors.Wrapf(b.first, "failed to %s %d of %d items", desc,
+		b.numFailed, b.numTotal)
+}
+
+// MetaQueryUnder runs a metadata search in iRODS, as for MetaQuery, scoped to
+// the collection coll and its sub-collections, recursively. The query is
+// constrained by baton-do on the server and results outside the collection,
+// should any be returned, are discarded.
+func (client *Client) MetaQueryUnder(coll string, args Args,
+	item RodsItem) ([]RodsItem, error) {
+	item.IPath = path.Clean(coll)
+	item.IName = ""
+	args, item, err := client.resolve(args, item)
+	if err != nil {
+		return nil, err
+	}
+	coll = item.IPath
+
+	items, err := client.MetaQuery(args, item)
+	if err != nil {
+		return items, err
+	}
+
+	var under []RodsItem
+	for _, it := range items {
+		if isPathUnder(coll, it.RodsPath()) {
+			under = append(under, it)
+		}
+	}
+
+	return under, err
+}
+
+// isPathUnder returns true if path is root, or is within root.
+func isPathUnder(root string, path string) bool {
+	if root == "/" {
+		return strings.HasPrefix(path, "/")
+	}
+	return path == root || strings.HasPrefix(path, root+"/")
+}
+
+// filterByUnits returns those items which have, for each of the query AVUs,
+// an AVU with the same attribute and units. Where the query operator is
+// equality, the value must also match.
+func filterByUnits(items []RodsItem, query []AVU) []RodsItem {
+	var match []RodsItem
+
+	for _, item := range items {
+		ok := true
+		for _, q := range query {
+			if !hasMatchingUnits(item.IAVUs, q) {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			match = append(match, item)
+		}
+	}
+
+	return match
+}
+
+func hasMatchingUnits(avus []AVU, q AVU) bool {
+	equality := q.Operator == "" || q.Operator == "="
+
+	for _, avu := range avus {
+		if avu.Attr != q.Attr || avu.Units != q.Units {
+			continue
+		}
+		if equality && avu.Value != q.Value {
+			continue
+		}
+		return true
+	}
+
+	return false
+}
+
+// listRecurse lists the item recursively. If failures is not nil, a failure
+// to list a collection within the item is appended to it and the remainder
+// are listed.
+func (client *Client) listRecurse(args Args, item RodsItem,
+	failures *[]ListFailure) ([]RodsItem, error) {
 	var items []RodsItem
 
+	if client == nil {
+		return nil, noClientError(LIST, item)
+	}
+	args, item, err := client.resolve(args, item)
+	if err != nil {
+		return nil, err
+	}
+
 	if item.IsDataObject() {
 		item.client = client
 		return []RodsItem{item}, nil
@@ -679,10 +1775,23 @@ func (client *Client) listRecurse(args Args, item RodsItem) ([]RodsItem, error)
 	populated, err := client.execute(LIST, args, item)
 	if err == nil {
 		for _, elt := range populated[0].IContents {
-			if elt.IsCollection() {
-				content, err := client.listRecurse(args, elt)
+			if elt.IsCollection() && args.MaxDepth == 1 {
+				items = append(items, elt)
+			} else if elt.IsCollection() {
+				sub := args
+				if sub.MaxDepth > 1 {
+					sub.MaxDepth--
+				}
+				var content []RodsItem
+				content, err = client.listRecurse(sub, elt, failures)
 				if err != nil {
-					break
+					if failures == nil {
+						return nil, err
+					}
+					*failures = append(*failures,
+						ListFailure{Path: elt.RodsPath(), Err: err})
+					err = nil
+					continue
 				}
 
 				items = append(items, content...)
@@ -691,7 +1800,9 @@ func (client *Client) listRecurse(args Args, item RodsItem) ([]RodsItem, error)
 			}
 		}
 	}
-	SortRodsItems(items)
+	if client.SortResults() {
+		SortRodsItems(items)
+	}
 
 	for i := range items {
 		items[i].client = client
@@ -700,8 +1811,13 @@ func (client *Client) listRecurse(args Args, item RodsItem) ([]RodsItem, error)
 	return items, err
 }
 
-func (client *Client) putRecurse(args Args, item RodsItem) ([]RodsItem, error) {
+func (client *Client) putRecurse(ctx context.Context, args Args,
+	item RodsItem) ([]RodsItem, error) {
 	var newItems []RodsItem
+	args, item, err := client.resolve(args, item)
+	if err != nil {
+		return newItems, err
+	}
 
 	// It is just a simple data object
 	if item.IsLocalFile() && (item.IsDataObject() || item.IsCollection()) {
@@ -722,6 +1838,62 @@ func (client *Client) putRecurse(args Args, item RodsItem) ([]RodsItem, error) {
 	log := logs.GetLogger()
 	rodsRoot := item.RodsPath()
 
+	newItems, emptyColls, werr := client.planPut(item.LocalPath(), rodsRoot,
+		args.EmptyDirs)
+	if werr != nil {
+		return newItems, werr
+	}
+
+	for i, elt := range newItems {
+		if err := ctx.Err(); err != nil {
+			log.Info().Str("path", rodsRoot).Int("transferred", i).
+				Int("total", len(newItems)).Msg("recursive put cancelled")
+			return newItems[:i], err
+		}
+
+		// Create the leading collections, if they are not there
+		coll := RodsItem{IPath: elt.IPath}
+		_, cerr := client.execute(MKDIR, Args{Recurse: true}, coll)
+		if cerr != nil {
+			return newItems, cerr
+		}
+
+		// Put the data object
+		objs, oerr := client.execute(PUT, args, elt)
+		if oerr != nil {
+			return newItems, oerr
+		}
+
+		// Update newItems with a populated item
+		newItems[i] = objs[0]
+	}
+
+	for _, path := range emptyColls {
+		if err := ctx.Err(); err != nil {
+			return newItems, err
+		}
+
+		colls, cerr := client.execute(MKDIR, Args{Recurse: true},
+			RodsItem{IPath: path})
+		if cerr != nil {
+			return newItems, cerr
+		}
+		newItems = append(newItems, colls[0])
+	}
+
+	return newItems, nil
+}
+
+// planPut walks the local directory localRoot and returns the data objects to
+// be made when putting it recursively into the collection rodsRoot, as for
+// putRecurse, without putting them. If emptyDirs is true, the paths of the
+// collections to be made for any empty local directories are also returned.
+func (client *Client) planPut(localRoot string, rodsRoot string,
+	emptyDirs bool) ([]RodsItem, []string, error) {
+	log := logs.GetLogger()
+
+	var newItems []RodsItem
+	var emptyColls []string
 	walkFn := func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			if os.IsNotExist(err) {
@@ -733,13 +1905,32 @@ func (client *Client) putRecurse(args Args, item RodsItem) ([]RodsItem, error) {
 			return err
 		}
 
+		if info.IsDir() && emptyDirs {
+			entries, derr := os.ReadDir(path)
+			if derr != nil {
+				return derr
+			}
+			if len(entries) == 0 {
+				rodsDir, perr := rodsSubPath(localRoot, rodsRoot, path)
+				if perr != nil {
+					return perr
+				}
+				emptyColls = append(emptyColls, rodsDir)
+			}
+		}
+
 		if !info.IsDir() {
 			dir := filepath.Dir(path)
+			rodsDir, perr := rodsSubPath(localRoot, rodsRoot, dir)
+			if perr != nil {
+				return perr
+			}
+
 			obj := RodsItem{
 				client:     client,
 				IDirectory: dir,
 				IFile:      info.Name(),
-				IPath:      filepath.Clean(filepath.Join(rodsRoot, dir)),
+				IPath:      rodsDir,
 				IName:      info.Name()}
 			newItems = append(newItems, obj)
 		}
@@ -747,30 +1938,28 @@ func (client *Client) putRecurse(args Args, item RodsItem) ([]RodsItem, error) {
 		return err
 	}
 
-	werr := filepath.Walk(item.LocalPath(), walkFn)
-	if werr != nil {
-		return newItems, werr
-	}
-
-	for i, elt := range newItems {
-		// Create the leading collections, if they are not there
-		coll := RodsItem{IPath: elt.IPath}
-		_, cerr := client.execute(MKDIR, Args{Recurse: true}, coll)
-		if cerr != nil {
-			return newItems, cerr
-		}
+	err := filepath.Walk(localRoot, walkFn)
 
-		// Put the data object
-		objs, oerr := client.execute(PUT, args, elt)
-		if oerr != nil {
-			return newItems, oerr
-		}
+	return newItems, emptyColls, err
+}
 
-		// Update newItems with a populated item
-		newItems[i] = objs[0]
+// rodsSubPath returns the iRODS collection path corresponding to the local
+// directory localDir, found while walking the local directory localRoot, when
+// localRoot is being put into the collection rodsRoot. The last element of
+// localRoot becomes a sub-collection of rodsRoot, whether localRoot is
+// relative or absolute. e.g. putting "/a/b/testdata" or "testdata" into
+// "/zone/coll" maps "<localRoot>/1/reads" to "/zone/coll/testdata/1/reads".
+func rodsSubPath(localRoot string, rodsRoot string, localDir string) (string, error) {
+	rel, err := filepath.Rel(filepath.Dir(filepath.Clean(localRoot)), localDir)
+	if err != nil {
+		return "", err
+	}
+	if rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", errors.Errorf("local directory '%s' is not within '%s'",
+			localDir, localRoot)
 	}
 
-	return newItems, nil
+	return filepath.Clean(filepath.Join(rodsRoot, rel)), nil
 }
 
 // execute sends JSON to a baton-do process, which in turn passes a request to
@@ -778,32 +1967,125 @@ func (client *Client) putRecurse(args Args, item RodsItem) ([]RodsItem, error) {
 // iRODS server is being run.
 func (client *Client) execute(op string, args Args, item RodsItem) ([]RodsItem,
 	error) {
+	args, item, err := client.resolve(args, item)
+	if err != nil {
+		return []RodsItem{}, err
+	}
+	if err = client.begin(op, args, item); err != nil {
+		return []RodsItem{}, err
+	}
+
+	response, err := client.send(wrap(op, args, item))
+	if err != nil {
+		return nil, err
+	}
+
+	return unwrap(client, response)
+}
+
+// begin checks that an operation may be sent and records the activity.
+func (client *Client) begin(op string, args Args, item RodsItem) error {
+	// Items unmarshalled from JSON, or made without a constructor, have no
+	// client. Their methods arrive here with a nil receiver.
+	if client == nil {
+		return noClientError(op, item)
+	}
 	if !client.IsRunning() {
-		return []RodsItem{}, errors.New("client is not running")
+		return errors.New("client is not running")
+	}
+	if err := item.Validate(op); err != nil {
+		return err
+	}
+	if err := validateSubOperation(op, args); err != nil {
+		return err
 	}
 
 	client.Lock()
 	client.activityTime = time.Now()
+	client.numOps++
 	client.Unlock()
 
-	response, err := client.send(wrap(op, args, item))
+	return nil
+}
+
+// validateSubOperation returns an error if Args.Operation is not valid for the
+// baton operation op. Only a metamod operation has a sub-operation, which it
+// requires.
+func validateSubOperation(op string, args Args) error {
+	switch {
+	case op == METAMOD && (args.Operation == METAADD || args.Operation == METAREM):
+		return nil
+	case op == METAMOD:
+		return errors.Errorf("invalid %s sub-operation '%s'", op,
+			args.Operation)
+	case args.Operation != "":
+		return errors.Errorf("invalid argument: %s operation does not "+
+			"permit a sub-operation, but '%s' was set", op, args.Operation)
+	}
+
+	return nil
+}
+
+// nextRequestID returns a new request ID, unique within the client.
+func (client *Client) nextRequestID() uint64 {
+	client.Lock()
+	defer client.Unlock()
+
+	client.lastID++
+	return client.lastID
+}
+
+func noClientError(op string, item RodsItem) error {
+	return errors.Errorf("%s operation on '%s' failed: item has no "+
+		"associated client", op, item.String())
+}
+
+func (client *Client) send(envelope *Envelope) (*Envelope, error) {
+	if err := client.sendRequest(envelope); err != nil {
+		return nil, err
+	}
+
+	response, err := client.receive()
 	if err != nil {
 		return nil, err
 	}
 
-	return unwrap(client, response)
+	// If baton-do does not echo the request ID, the response is to the
+	// request just sent, because requests are handled one at a time.
+	switch response.ID {
+	case 0:
+		response.ID = envelope.ID
+	case envelope.ID:
+	default:
+		return nil, &ProtocolError{errors.Errorf("response to %s operation "+
+			"has request ID %d, expected %d", response.Operation, response.ID,
+			envelope.ID)}
+	}
+
+	return response, err
 }
 
-func (client *Client) send(envelope *Envelope) (*Envelope, error) {
-	log := logs.GetLogger()
+// sendRequest assigns the next request ID to an envelope and writes it to the
+// sub-process, without waiting for the response.
+func (client *Client) sendRequest(envelope *Envelope) error {
+	envelope.ID = client.nextRequestID()
 
 	jsonMessage, err := json.Marshal(envelope)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	log.Debug().Msgf("Sending %s", jsonMessage)
-	client.in <- jsonMessage
+	logs.GetLogger().Debug().Uint64("id", envelope.ID).
+		Msgf("Sending %s", jsonMessage)
+
+	return client.write(jsonMessage)
+}
+
+// receive waits for the next response from the sub-process. Lines written to
+// STDOUT that are not JSON objects, such as diagnostic messages, are not
+// responses; they are logged and skipped.
+func (client *Client) receive() (*Envelope, error) {
+	log := logs.GetLogger()
 
 	var jsonResponse []byte
 
@@ -811,7 +2093,12 @@ waitResponse:
 	for {
 		select {
 		case jsonResponse = <-client.out:
-			log.Debug().Msgf("Received %s", jsonResponse)
+			if !isJSONObject(jsonResponse) {
+				log.Warn().Str("executable", client.path).
+					Str("stdout", string(jsonResponse)).
+					Msg("skipping non-JSON output on stdout")
+				continue
+			}
 			break waitResponse
 
 		case <-time.After(client.respTimeout):
@@ -829,11 +2116,83 @@ waitResponse:
 	}
 
 	response := &Envelope{}
-	if err = json.Unmarshal(jsonResponse, response); err != nil {
-		return nil, err
+	if err := json.Unmarshal(jsonResponse, response); err != nil {
+		log.Debug().Msgf("Received %s", jsonResponse)
+
+		// A sub-process killed part way through writing its response can leave
+		// a truncated document. Report that, rather than the JSON syntax error.
+		if client.stopsWithin(truncatedResponseGrace) {
+			return nil, &ProtocolError{errors.Wrapf(err, "baton-do terminated "+
+				"unexpectedly while responding. PID: %d, response: '%s'",
+				client.pid, jsonResponse)}
+		}
+
+		return nil, &ProtocolError{errors.Wrapf(err, "invalid JSON response "+
+			"from baton-do: '%s'", jsonResponse)}
 	}
+	log.Debug().Uint64("id", response.ID).Msgf("Received %s", jsonResponse)
 
-	return response, err
+	return response, nil
+}
+
+// isJSONObject returns true if line appears to be a JSON object, although it
+// may be invalid or truncated.
+func isJSONObject(line []byte) bool {
+	trimmed := bytes.TrimLeft(line, " \t")
+	return len(trimmed) > 0 && trimmed[0] == '{'
+}
+
+// stopsWithin returns true if the client is not running, or stops running
+// within the timeout.
+func (client *Client) stopsWithin(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+
+	for client.IsRunning() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return true
+}
+
+// write passes a message to the STDIN goroutine and waits for it to be written
+// to the sub-process. If this takes longer than the write timeout, the
+// sub-process is assumed to be wedged and is killed, so that the client stops
+// running and subsequent operations fail fast.
+func (client *Client) write(message []byte) error {
+	timeout := time.NewTimer(client.writeTimeout)
+	defer timeout.Stop()
+
+	select {
+	case client.in <- message:
+	case <-timeout.C:
+		return client.killWedged()
+	}
+
+	select {
+	case err := <-client.written:
+		return err
+	case <-timeout.C:
+		return client.killWedged()
+	}
+}
+
+func (client *Client) killWedged() error {
+	pid := client.ClientPid()
+
+	logs.GetLogger().Error().Str("executable", client.path).Int("pid", pid).
+		Dur("timeout", client.writeTimeout).
+		Msg("sending timed out, killing the client")
+
+	if err := client.cmd.Process.Kill(); err != nil {
+		return errors.Wrapf(err, "failed to kill client PID %d after "+
+			"sending timed out", pid)
+	}
+
+	return errors.Errorf("sending failed because the client did not accept "+
+		"input within %s. PID: %d", client.writeTimeout, pid)
 }
 
 // wrap adds the JSON envelope to the iRODS operation. See the baton-do
@@ -842,8 +2201,40 @@ func wrap(operation string, args Args, target RodsItem) *Envelope {
 	return &Envelope{Operation: operation, Arguments: args, Target: target}
 }
 
+// BuildEnvelope returns the JSON request envelope for the baton-do operation op
+// on item, with arguments args, without sending it. It is the counterpart of
+// ParseEnvelope, for inspecting requests or for driving baton-do directly. The
+// envelope has no request ID. An error is returned if the item or arguments
+// are not valid for the operation.
+func BuildEnvelope(op string, args Args, item RodsItem) ([]byte, error) {
+	if err := item.Validate(op); err != nil {
+		return nil, err
+	}
+	if err := validateSubOperation(op, args); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(wrap(op, args, item))
+}
+
+// ParseEnvelope parses a baton-do response envelope, for example one captured
+// from baton-do output, and returns any RodsItems or error from the iRODS
+// operation, as for a response received by a Client. The RodsItems are sorted
+// and have no Client set. An error from the iRODS operation is a RodsError;
+// data that is not a valid envelope gives a ProtocolError.
+func ParseEnvelope(data []byte) ([]RodsItem, error) {
+	envelope := &Envelope{}
+	if err := json.Unmarshal(data, envelope); err != nil {
+		return []RodsItem{}, &ProtocolError{errors.Wrapf(err,
+			"invalid baton-do envelope: '%s'", data)}
+	}
+
+	return unwrap(nil, envelope)
+}
+
 // unwrap removes the envelope from JSON returned by baton-do and returns any
-// RodsItems or error from the iRODS operation.
+// RodsItems or error from the iRODS operation. The RodsItems are sorted, unless
+// the client has sorting disabled. The client may be nil.
 func unwrap(client *Client, envelope *Envelope) ([]RodsItem, error) {
 	var items []RodsItem
 	if envelope.ErrorMsg != nil {
@@ -855,8 +2246,8 @@ func unwrap(client *Client, envelope *Envelope) ([]RodsItem, error) {
 	}
 
 	if envelope.Result == nil {
-		return items, errors.Errorf("invalid %s operation "+
-			"envelope (no result)", envelope.Operation)
+		return items, &ProtocolError{errors.Errorf("invalid %s operation "+
+			"envelope (no result)", envelope.Operation)}
 	}
 
 	switch {
@@ -865,12 +2256,10 @@ func unwrap(client *Client, envelope *Envelope) ([]RodsItem, error) {
 	case envelope.Result.Item != nil:
 		items = []RodsItem{*envelope.Result.Item}
 	default:
-		return items, errors.Errorf("invalid %s operation "+
-			"result (no content)", envelope.Operation)
+		return items, &ProtocolError{errors.Errorf("invalid %s operation "+
+			"result (no content)", envelope.Operation)}
 	}
 
-	SortRodsItems(items)
-
 	for i := range items {
 		items[i].client = client
 
@@ -878,6 +2267,16 @@ func unwrap(client *Client, envelope *Envelope) ([]RodsItem, error) {
 		for j := range contents {
 			contents[j].client = client
 		}
+	}
+
+	if client != nil && !client.SortResults() {
+		return items, nil
+	}
+
+	SortRodsItems(items)
+
+	for i := range items {
+		var contents = items[i].IContents
 		SortRodsItems(contents)
 		items[i].IContents = contents
 
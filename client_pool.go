@@ -21,6 +21,8 @@
 package extendo
 
 import (
+	"context"
+	"runtime/debug"
 	"sync"
 	"time"
 
@@ -39,24 +41,41 @@ import (
 // the ClientPool's Get() and Return() methods to obtain and release Clients.
 //
 // Once a ClientPool has been created it may be closed. A closed pool will
-// return an error on Get(), but will allow Return(). A closed pool may not
-// be re-opened.
+// return an error on Get(), but will allow Return(). A closed pool may be
+// re-opened with Reopen().
 type ClientPool struct {
-	clientArgs        []string      // baton-do arguments.
-	getTimeout        time.Duration // Timeout for Get().
-	getMaxRetries     uint8         // Max retries for Get().
-	checkClientFreq   time.Duration // Frequency at which clients are checked.
-	maxClientIdleTime time.Duration // Idle time after which clients will be stopped.
-	maxClientRuntime  time.Duration // Runtime after which clients will be stopped.
-	sync.RWMutex                    // Lock for IsOpen(), Get(), Return() and Close().
-	isOpen            bool          // True if the pool is open.
-	clients           []*Client     // Running clients in the pool.
-	numClients        uint8         // The number of clients created by the pool.
-	maxSize           uint8         // The maximum number of clients permitted.
+	clientArgs          []string      // baton-do arguments.
+	getTimeout          time.Duration // Timeout for Get().
+	getMaxRetries       uint8         // Max tries for Get() (at least 1 is made).
+	checkClientFreq     time.Duration // Frequency at which clients are checked.
+	maxClientIdleTime   time.Duration // Idle time after which clients will be stopped.
+	maxClientRuntime    time.Duration // Runtime after which clients will be stopped.
+	maxClientOperations uint64        // Operations after which clients will be stopped.
+	minIdle             uint8         // Number of idle clients that will not be stopped.
+	balance             bool          // Get the client with the most remaining budget.
+	leakTimeout         time.Duration // Time after which a client not returned is reported.
+	borrowed            borrowings    // Clients got, while leakTimeout is set.
+	sync.RWMutex                      // Lock for IsOpen(), Get(), Return() and Close().
+	isOpen              bool          // True if the pool is open.
+	clients             []*Client     // Running clients in the pool.
+	numClients          uint8         // The number of clients created by the pool.
+	maxSize             uint8         // The maximum number of clients permitted.
+	checkStop           chan struct{} // Closed to stop checkClients().
+}
+
+// borrowings records the clients got from the pool and not yet returned.
+type borrowings map[*Client]*borrowing
+
+// borrowing records where and when a client was got from the pool.
+type borrowing struct {
+	stack    []byte    // Stack trace of the call to Get().
+	since    time.Time // Time of the call to Get().
+	reported bool      // True if the client has been reported as leaked.
 }
 
 var (
 	errPoolClosed = errors.New("the client pool is closed")
+	errPoolOpen   = errors.New("the client pool is already open")
 	errPoolEmpty  = errors.New("the client pool is empty")
 	errDeadClient = errors.New("dead client in the client pool")
 	errGetTimeout = errors.New("timeout getting client from the pool")
@@ -64,12 +83,16 @@ var (
 
 // ClientPoolParams describes the available parameters for pool creation.
 type ClientPoolParams struct {
-	MaxSize           uint8         // Maximum number of clients.
-	GetTimeout        time.Duration // Timeout for Get()
-	GetMaxRetries     uint8         // Max retries for Get().
-	CheckClientFreq   time.Duration // Frequency of check for old, idle or stopped clients.
-	MaxClientRuntime  time.Duration // Runtime after which clients are considered old.
-	MaxClientIdleTime time.Duration // Inactivity time after which clients are considered idle.
+	MaxSize             uint8         // Maximum number of clients.
+	GetTimeout          time.Duration // Timeout for Get()
+	GetMaxRetries       uint8         // Max tries for Get() (at least 1 is made).
+	CheckClientFreq     time.Duration // Frequency of check for old, idle or stopped clients.
+	MaxClientRuntime    time.Duration // Runtime after which clients are considered old.
+	MaxClientIdleTime   time.Duration // Inactivity time after which clients are considered idle.
+	MaxClientOperations uint64        // Operations after which clients are considered old (0 for no limit).
+	MinIdle             uint8         // Minimum number of idle clients to keep running.
+	Balance             bool          // Get the client with the most remaining runtime or operations.
+	LeakTimeout         time.Duration // Time after which a client not returned is reported (0 to disable).
 }
 
 // DefaultClientPoolParams is default argument values for client pool creation.
@@ -82,32 +105,77 @@ var DefaultClientPoolParams = ClientPoolParams{
 	MaxClientIdleTime: time.Minute * 10,
 }
 
+// Validate returns an error if the parameters would create a pool that is
+// unable to provide Clients.
+func (params ClientPoolParams) Validate() error {
+	switch {
+	case params.MaxSize == 0:
+		return errors.New("invalid client pool parameters: MaxSize must be > 0")
+	case params.GetTimeout <= 0:
+		return errors.New("invalid client pool parameters: " +
+			"GetTimeout must be > 0")
+	case params.CheckClientFreq <= 0:
+		return errors.New("invalid client pool parameters: " +
+			"CheckClientFreq must be > 0")
+	case params.MaxClientRuntime <= 0:
+		return errors.New("invalid client pool parameters: " +
+			"MaxClientRuntime must be > 0")
+	case params.MaxClientIdleTime <= 0:
+		return errors.New("invalid client pool parameters: " +
+			"MaxClientIdleTime must be > 0")
+	case params.MinIdle > params.MaxSize:
+		return errors.Errorf("invalid client pool parameters: "+
+			"MinIdle %d must be <= MaxSize %d", params.MinIdle, params.MaxSize)
+	}
+
+	return nil
+}
+
 // NewClientPool creates a new pool that will hold up to params.MaxSize
 // Clients. The Get() method will try to obtain a running Client on request for
 // up to the specified params.construction before returning an error. The
 // clientArgs arguments will be passed to the FindAndStart() method when
-// creating each new Client.
+// creating each new Client. The params are not checked; use
+// NewClientPoolChecked to reject invalid params.
 func NewClientPool(params ClientPoolParams, clientArgs ...string) *ClientPool {
 
 	processedArgs := []string{"--unbuffered", "--no-error"} // Always need this
 	processedArgs = utilities.Uniq(append(processedArgs, clientArgs...))
 
 	pool := ClientPool{
-		clientArgs:        processedArgs,
-		getTimeout:        params.GetTimeout,
-		getMaxRetries:     params.GetMaxRetries,
-		checkClientFreq:   params.CheckClientFreq,
-		maxClientRuntime:  params.MaxClientRuntime,
-		maxClientIdleTime: params.MaxClientIdleTime,
-		isOpen:            true,
-		maxSize:           params.MaxSize,
+		clientArgs:          processedArgs,
+		getTimeout:          params.GetTimeout,
+		getMaxRetries:       params.GetMaxRetries,
+		checkClientFreq:     params.CheckClientFreq,
+		maxClientRuntime:    params.MaxClientRuntime,
+		maxClientIdleTime:   params.MaxClientIdleTime,
+		maxClientOperations: params.MaxClientOperations,
+		minIdle:             params.MinIdle,
+		balance:             params.Balance,
+		leakTimeout:         params.LeakTimeout,
+		borrowed:            make(borrowings),
+		isOpen:              true,
+		maxSize:             params.MaxSize,
+		checkStop:           make(chan struct{}),
 	}
 
-	go pool.checkClients()
+	go pool.checkClients(pool.checkStop)
 
 	return &pool
 }
 
+// NewClientPoolChecked creates a new pool, as NewClientPool does, after checking
+// the params with ClientPoolParams.Validate(). It returns an error if they are
+// invalid.
+func NewClientPoolChecked(params ClientPoolParams,
+	clientArgs ...string) (*ClientPool, error) {
+	if err := params.Validate(); err != nil {
+		return nil, err
+	}
+
+	return NewClientPool(params, clientArgs...), nil
+}
+
 // IsOpen returns true if the pool is open.
 func (pool *ClientPool) IsOpen() bool {
 	pool.RLock()
@@ -119,32 +187,53 @@ func (pool *ClientPool) IsOpen() bool {
 // Get returns a running Client from the pool, or creates a new one. It returns
 // an error if the pool is closed, if the attempt to get a Client exceeds the
 // pool's timeout, or if an error is encountered creating the Client.
+//
+// By default, the Client most recently returned is supplied. If the pool was
+// created with ClientPoolParams.Balance set, the Client with the most
+// remaining budget before it is retired for its runtime or operation count is
+// supplied instead. This spreads use across the clients, so that they approach
+// their limits together rather than some being retired while others idle.
+//
+// If the pool was created with ClientPoolParams.LeakTimeout set, a Client
+// that has not been returned within that time is reported as leaked by a
+// warning in the log, including the stack trace of the call to Get.
 func (pool *ClientPool) Get() (*Client, error) {
 	return pool.getWithRetries()
 }
 
 // Tries up to getMaxRetries times to get a Client, each time with a timeout.
+// Despite its name, getMaxRetries counts every try, including the first. At
+// least one try is always made, so a value of 0 is treated as 1.
 func (pool *ClientPool) getWithRetries() (*Client, error) {
 	log := logs.GetLogger()
 
-	for try := 0; try < int(pool.getMaxRetries); try++ {
+	maxTries := max(1, int(pool.getMaxRetries))
+	for try := 1; try <= maxTries; try++ {
 		log.Debug().Int("try", try).Msg("getting a client")
 
 		client, err := pool.getWithTimeout()
 		if err != nil {
-			log.Error().Err(err).Int("try", try).Msg("retrying")
+			log.Error().Err(err).Int("try", try).Msg("failed to get a client")
 			continue
 		}
 		if !client.IsRunning() {
-			log.Error().Err(errDeadClient).Int("try", try).Msg("retrying")
+			log.Error().Err(errDeadClient).Int("try", try).
+				Msg("failed to get a client")
 			continue
 		}
 
+		if pool.leakTimeout > 0 {
+			pool.Lock()
+			pool.borrowed[client] = &borrowing{stack: debug.Stack(),
+				since: time.Now()}
+			pool.Unlock()
+		}
+
 		return client, nil
 	}
 
 	return nil, errors.Errorf("failed to get a client from the pool "+
-		"after %d tries", pool.getMaxRetries)
+		"after %d tries", maxTries)
 }
 
 // Tries to get or create a Client, with a timeout.
@@ -197,12 +286,16 @@ func (pool *ClientPool) getWithTimeout() (*Client, error) {
 // checkClients periodically, while to pool is open, examines all the unused
 // clients in the pool to see whether any of them can be stopped and discarded.
 // The reasons for discarding clients are: have been running for longer than
-// the maxClientRuntime, have been idle longer than the maxClientIdleTime, or
-// have stopped for another reason e.g. crashed or externally terminated.
+// the maxClientRuntime, have been idle longer than the maxClientIdleTime, have
+// performed maxClientOperations operations (if set), or have stopped for
+// another reason e.g. crashed or externally terminated. Idle clients are not
+// stopped while doing so would leave fewer than minIdle clients in the pool,
+// so that a bursty workload does not repeatedly pay the cost of starting them.
+// The clients most recently returned are those retained.
 //
 // As the clients are unused and the pool is locked during this process, there
 // is no danger of disconnecting an active client.
-func (pool *ClientPool) checkClients() {
+func (pool *ClientPool) checkClients(stop <-chan struct{}) {
 	checkTick := time.NewTicker(pool.checkClientFreq)
 	defer checkTick.Stop()
 
@@ -210,6 +303,9 @@ func (pool *ClientPool) checkClients() {
 
 	for {
 		select {
+		case <-stop:
+			log.Debug().Msg("stopping client check")
+			return
 		case <-checkTick.C:
 			pool.Lock()
 			if !pool.isOpen {
@@ -220,7 +316,9 @@ func (pool *ClientPool) checkClients() {
 
 			var keep []*Client
 			numRemoved := uint8(0)
-			for _, c := range pool.clients {
+			// From the top of the stack i.e. most recently returned first
+			for i := len(pool.clients) - 1; i >= 0; i-- {
+				c := pool.clients[i]
 				rt := c.Runtime()
 
 				if !c.IsRunning() {
@@ -234,7 +332,16 @@ func (pool *ClientPool) checkClients() {
 						Msg("stopping long running client")
 					stopAndLog(c, log)
 					numRemoved++
-				} else if c.IdleTime() > pool.maxClientIdleTime {
+				} else if pool.maxClientOperations > 0 &&
+					c.OperationCount() >= pool.maxClientOperations {
+					log.Debug().Int("pid", c.ClientPid()).
+						Uint64("operations", c.OperationCount()).
+						Uint64("max_operations", pool.maxClientOperations).
+						Msg("stopping heavily used client")
+					stopAndLog(c, log)
+					numRemoved++
+				} else if c.IdleTime() > pool.maxClientIdleTime &&
+					uint8(len(keep)) >= pool.minIdle {
 					log.Debug().Int("pid", c.ClientPid()).
 						Dur("runtime", rt).
 						Msg("stopping idle client")
@@ -246,10 +353,14 @@ func (pool *ClientPool) checkClients() {
 			}
 
 			if uint8(len(keep)) != pool.size() {
+				for i, j := 0, len(keep)-1; i < j; i, j = i+1, j-1 {
+					keep[i], keep[j] = keep[j], keep[i]
+				}
 				pool.clients = keep
 				pool.numClients = pool.numClients - numRemoved
 			}
 
+			pool.reportLeaks(log)
 			pool.Unlock()
 		}
 	}
@@ -260,36 +371,251 @@ func (pool *ClientPool) checkClients() {
 // method will discard it and decrement the client count so that a new one can
 // be created. If the pool has been closed, clients may still be returned,
 // where they will be stopped and any errors from this ignored.
+//
+// Clients that are discarded while running are stopped after the pool lock
+// has been released, so that waiting for a sub-process to exit does not block
+// other users of the pool.
 func (pool *ClientPool) Return(client *Client) error {
 	log := logs.GetLogger()
 
 	pool.Lock()
-	defer pool.Unlock()
+	delete(pool.borrowed, client)
+
+	switch {
+	case !pool.isOpen:
+		pool.numClients--
+		pool.Unlock()
 
-	if !pool.isOpen {
 		log.Debug().Msg("discarding 1 client returned to a closed pool")
 		client.StopIgnoreError()
 		return nil
-	}
 
-	if !client.IsRunning() {
-		log.Debug().Msg("discarding 1 client (stopped)")
+	case !client.IsRunning():
 		pool.numClients--
+		pool.Unlock()
+
+		log.Debug().Msg("discarding 1 client (stopped)")
 		return nil
-	}
 
-	if pool.size() < pool.maxSize {
+	case pool.size() < pool.maxSize:
 		pool.push(client)
+		size := pool.size()
+		pool.Unlock()
+
 		log.Debug().Msgf("returned 1 client (running) to the pool making %d",
-			pool.size())
+			size)
 		return nil
 	}
+	pool.Unlock()
 
 	log.Debug().Msg("discarding 1 client (running), pool full")
 
 	return client.Stop()
 }
 
+// WithClient gets a client from the pool, passes it to fn and returns it to
+// the pool when fn completes, whether fn returns an error or panics. This
+// allows a sequence of operations to use the same client without the risk of
+// failing to return it. The error from fn is returned, or an error from
+// returning the client, if fn succeeded.
+func (pool *ClientPool) WithClient(fn func(*Client) error) (err error) {
+	client, err := pool.Get()
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if rerr := pool.Return(client); rerr != nil {
+			if err == nil {
+				err = rerr
+			} else {
+				logs.GetLogger().Error().Err(rerr).
+					Msg("failed to return client")
+			}
+		}
+	}()
+
+	return fn(client)
+}
+
+// RemoveMetadataFromQuery runs a metadata search in iRODS and removes the
+// argument AVUs from every matching item, as for the Client method of the same
+// name, using up to the pool's maximum number of clients concurrently.
+func (pool *ClientPool) RemoveMetadataFromQuery(args Args, queryItem RodsItem,
+	avus []AVU) error {
+	return pool.applyToQuery(args, queryItem, "remove metadata from",
+		func(client *Client, item RodsItem) error {
+			return removeMetadataFrom(client, item, avus)
+		})
+}
+
+// ChmodQueryResults runs a metadata search in iRODS and applies the argument
+// ACLs to every matching item, as for the Client method of the same name,
+// using up to the pool's maximum number of clients concurrently.
+func (pool *ClientPool) ChmodQueryResults(args Args, queryItem RodsItem,
+	acls []ACL) error {
+	return pool.applyToQuery(args, queryItem, "set ACLs on",
+		func(client *Client, item RodsItem) error {
+			return chmodItem(client, item, acls)
+		})
+}
+
+// applyToQuery runs a metadata search in iRODS and calls fn for every
+// matching item, using up to the pool's maximum number of clients
+// concurrently. The errors from fn are reported as for bulkErrors, using desc
+// to describe the operation.
+func (pool *ClientPool) applyToQuery(args Args, queryItem RodsItem, desc string,
+	fn func(client *Client, item RodsItem) error) error {
+	var items []RodsItem
+	err := pool.WithClient(func(client *Client) (qerr error) {
+		items, qerr = client.MetaQuery(args, queryItem)
+		return qerr
+	})
+	if err != nil {
+		return err
+	}
+
+	return pool.applyToItems(items, desc, fn)
+}
+
+// applyToItems calls fn for every item, using up to the pool's maximum number
+// of clients concurrently. The errors from fn are reported as for bulkErrors,
+// using desc to describe the operation.
+func (pool *ClientPool) applyToItems(items []RodsItem, desc string,
+	fn func(client *Client, item RodsItem) error) error {
+	numWorkers := int(pool.maxSize)
+	if len(items) < numWorkers {
+		numWorkers = len(items)
+	}
+
+	jobs := make(chan RodsItem)
+	var bulk bulkErrors
+	var wg sync.WaitGroup
+
+	for i := 0; i < numWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			c, gerr := pool.Get()
+			if gerr != nil {
+				for item := range jobs {
+					bulk.add(item, gerr)
+				}
+				return
+			}
+			defer func() {
+				if rerr := pool.Return(c); rerr != nil {
+					logs.GetLogger().Error().Err(rerr).
+						Msg("failed to return client")
+				}
+			}()
+
+			for item := range jobs {
+				bulk.add(item, fn(c, item))
+			}
+		}()
+	}
+
+	for _, item := range items {
+		jobs <- item
+	}
+	close(jobs)
+	wg.Wait()
+
+	return bulk.err(desc)
+}
+
+// Warm starts up to n new clients and adds them to the pool, so that later
+// calls to Get do not wait for clients to start. No more clients are started
+// than the pool's maximum size allows. Warming stops when ctx is done, which is
+// not an error; the number of clients started is returned in either case. An
+// error is returned if the pool is closed or a client fails to start.
+func (pool *ClientPool) Warm(ctx context.Context, n uint8) (uint8, error) {
+	log := logs.GetLogger()
+
+	var numStarted uint8
+	for numStarted < n {
+		if ctx.Err() != nil {
+			log.Debug().Int("started", int(numStarted)).Int("requested", int(n)).
+				Msg("deadline reached warming the client pool")
+			return numStarted, nil
+		}
+
+		// Reserve a place for the client before starting it, so that the
+		// pool is not locked while it starts
+		pool.Lock()
+		if !pool.isOpen {
+			pool.Unlock()
+			return numStarted, errPoolClosed
+		}
+		if pool.numClients >= pool.maxSize {
+			pool.Unlock()
+			break
+		}
+		pool.numClients++
+		pool.Unlock()
+
+		client, err := FindAndStart(pool.clientArgs...)
+
+		pool.Lock()
+		if err != nil {
+			pool.numClients--
+			pool.Unlock()
+			return numStarted, err
+		}
+		if !pool.isOpen {
+			pool.numClients--
+			pool.Unlock()
+			client.StopIgnoreError()
+			return numStarted, errPoolClosed
+		}
+		pool.push(client)
+		pool.Unlock()
+
+		numStarted++
+	}
+
+	log.Debug().Int("started", int(numStarted)).Int("requested", int(n)).
+		Msg("warmed the client pool")
+
+	return numStarted, nil
+}
+
+// Drain stops all the idle clients in the pool and then waits for the clients
+// in use to be returned, stopping each of those in turn, until none remain.
+// The pool remains open and new clients are created on demand. If ctx is done
+// before all the clients in use are returned, an error is returned.
+func (pool *ClientPool) Drain(ctx context.Context) error {
+	log := logs.GetLogger()
+	interval := time.Millisecond * 10
+
+	for {
+		pool.Lock()
+		idle := pool.clients
+		pool.clients = nil
+		pool.numClients -= uint8(len(idle))
+		numInUse := pool.numClients
+		pool.Unlock()
+
+		for _, c := range idle {
+			log.Debug().Int("pid", c.ClientPid()).Msg("draining client")
+			stopAndLog(c, log)
+		}
+
+		if numInUse == 0 {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return errors.Wrapf(ctx.Err(), "failed to drain the client "+
+				"pool with %d clients in use", numInUse)
+		case <-time.After(interval):
+		}
+	}
+}
+
 // Close closes the pool for further Get() operations. Clients may still be
 // returned to a closed pool, see Return().
 func (pool *ClientPool) Close() {
@@ -300,6 +626,7 @@ func (pool *ClientPool) Close() {
 		return
 	}
 	pool.isOpen = false
+	close(pool.checkStop)
 
 	log := logs.GetLogger()
 	log.Debug().Msgf("stopping %d clients", pool.size())
@@ -312,7 +639,30 @@ func (pool *ClientPool) Close() {
 
 		log.Debug().Int("pid", c.ClientPid()).Msg("stopping client")
 		stopAndLog(c, log)
+		pool.numClients--
+	}
+}
+
+// Reopen re-opens a closed pool for Get() operations. The pool starts empty,
+// with new clients being created on demand. Any clients obtained before the
+// pool was closed still count towards its maximum size until they are
+// returned. Reopening a pool that is already open returns an error.
+func (pool *ClientPool) Reopen() error {
+	pool.Lock()
+	defer pool.Unlock()
+
+	if pool.isOpen {
+		return errPoolOpen
 	}
+	pool.isOpen = true
+	pool.checkStop = make(chan struct{})
+
+	logs.GetLogger().Debug().
+		Msgf("reopened the client pool with %d clients in use", pool.numClients)
+
+	go pool.checkClients(pool.checkStop)
+
+	return nil
 }
 
 // size returns the number of clients currently available in the pool.
@@ -324,16 +674,45 @@ func (pool *ClientPool) isEmpty() bool {
 	return pool.size() == 0
 }
 
-// pop returns the top client in the pool.
+// pop returns the top client in the pool or, if the pool is balanced, the
+// client with the most remaining budget.
 func (pool *ClientPool) pop() (*Client, error) {
 	if pool.isEmpty() {
 		return nil, errPoolEmpty
 	}
 
-	n := pool.size()
-	stack, top := pool.clients[:n-1], pool.clients[n-1]
-	pool.clients = stack
-	return top, nil
+	n := int(pool.size())
+	i := n - 1
+	if pool.balance {
+		best := pool.remainingBudget(pool.clients[i])
+		for j := i - 1; j >= 0; j-- {
+			if b := pool.remainingBudget(pool.clients[j]); b > best {
+				i, best = j, b
+			}
+		}
+	}
+
+	client := pool.clients[i]
+	pool.clients = append(pool.clients[:i], pool.clients[i+1:]...)
+	return client, nil
+}
+
+// remainingBudget returns the fraction of its runtime or of its operations,
+// whichever is the smaller, that the client may use before it is retired.
+func (pool *ClientPool) remainingBudget(client *Client) float64 {
+	budget := 1.0
+	if pool.maxClientRuntime > 0 {
+		budget = 1 - float64(client.Runtime())/float64(pool.maxClientRuntime)
+	}
+	if pool.maxClientOperations > 0 {
+		ops := 1 - float64(client.OperationCount())/
+			float64(pool.maxClientOperations)
+		if ops < budget {
+			budget = ops
+		}
+	}
+
+	return budget
 }
 
 // push adds a client to the top of the client pool.
@@ -341,6 +720,28 @@ func (pool *ClientPool) push(client *Client) {
 	pool.clients = append(pool.clients, client)
 }
 
+// reportLeaks logs a warning for each client that has not been returned to the
+// pool within the leak timeout. Each client is reported once. The pool must be
+// locked by the caller.
+func (pool *ClientPool) reportLeaks(log logs.Logger) {
+	if pool.leakTimeout <= 0 {
+		return
+	}
+
+	for c, b := range pool.borrowed {
+		if b.reported || time.Since(b.since) < pool.leakTimeout {
+			continue
+		}
+
+		log.Warn().Int("pid", c.ClientPid()).
+			Dur("borrowed_for", time.Since(b.since)).
+			Dur("leak_timeout", pool.leakTimeout).
+			Str("stack", string(b.stack)).
+			Msg("client has not been returned to the pool")
+		b.reported = true
+	}
+}
+
 func stopAndLog(client *Client, log logs.Logger) {
 	err := client.Stop()
 	if err != nil {
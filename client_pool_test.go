@@ -22,6 +22,9 @@
 package extendo_test
 
 import (
+	"context"
+	"errors"
+	"sync"
 	"time"
 
 	. "github.com/onsi/ginkgo/v2"
@@ -46,6 +49,48 @@ var _ = Describe("Make a client pool", func() {
 	})
 })
 
+var _ = Describe("Reopen a client pool", func() {
+	var pool *ex.ClientPool
+
+	BeforeEach(func() {
+		pool = ex.NewClientPool(ex.DefaultClientPoolParams)
+	})
+
+	AfterEach(func() {
+		pool.Close()
+	})
+
+	When("a pool is open", func() {
+		It("should not be reopenable", func() {
+			Expect(pool.Reopen()).To(MatchError("the client pool is already open"))
+		})
+	})
+
+	When("a pool is closed", func() {
+		BeforeEach(func() {
+			c, err := pool.Get()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(pool.Return(c)).To(Succeed())
+
+			pool.Close()
+		})
+
+		It("should be reopenable", func() {
+			Expect(pool.Reopen()).To(Succeed())
+			Expect(pool.IsOpen()).To(BeTrue())
+		})
+
+		It("should supply running clients after being reopened", func() {
+			Expect(pool.Reopen()).To(Succeed())
+
+			c, err := pool.Get()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(c.IsRunning()).To(BeTrue())
+			Expect(pool.Return(c)).To(Succeed())
+		})
+	})
+})
+
 var _ = Describe("Get clients from the pool", func() {
 	var poolSize = uint8(10)
 	var poolTimout = time.Millisecond * 250
@@ -176,6 +221,67 @@ var _ = Describe("Return clients to the pool", func() {
 	})
 })
 
+var _ = Describe("Return clients to a full pool concurrently", func() {
+	var poolSize = uint8(2)
+	var pool *ex.ClientPool
+	var extra []*ex.Client
+
+	BeforeEach(func() {
+		params := ex.DefaultClientPoolParams
+		params.MaxSize = poolSize
+		pool = ex.NewClientPool(params)
+
+		var clients []*ex.Client
+		for i := 0; i < int(poolSize); i++ {
+			c, err := pool.Get()
+			Expect(err).NotTo(HaveOccurred())
+			clients = append(clients, c)
+		}
+		for _, c := range clients {
+			Expect(pool.Return(c)).To(Succeed())
+		}
+
+		// Clients from outside the pool, which it has no room for
+		extra = nil
+		for i := 0; i < 10; i++ {
+			c, err := ex.FindAndStart(batonArgs...)
+			Expect(err).NotTo(HaveOccurred())
+			extra = append(extra, c)
+		}
+	})
+
+	AfterEach(func() {
+		pool.Close()
+	})
+
+	When("many clients are returned at once", func() {
+		It("should stop them all without blocking the pool", func() {
+			var wg sync.WaitGroup
+			errs := make(chan error, len(extra))
+
+			for _, c := range extra {
+				wg.Add(1)
+				go func(c *ex.Client) {
+					defer GinkgoRecover()
+					defer wg.Done()
+
+					errs <- pool.Return(c)
+					_ = pool.IsOpen()
+				}(c)
+			}
+			wg.Wait()
+			close(errs)
+
+			for err := range errs {
+				Expect(err).NotTo(HaveOccurred())
+			}
+			for _, c := range extra {
+				Expect(c.IsRunning()).To(BeFalse())
+			}
+		})
+	})
+})
+
 var _ = Describe("Pool client runtime timeout", func() {
 	var poolSize = uint8(10)
 	var poolTimout = time.Millisecond * 250
@@ -274,3 +380,247 @@ var _ = Describe("Pool client runtime timeout", func() {
 		})
 	})
 })
+
+var _ = Describe("Pool minimum idle clients", func() {
+	var pool *ex.ClientPool
+	var clients []*ex.Client
+
+	AfterEach(func() {
+		pool.Close()
+	})
+
+	When("clients have been idle longer than MaxClientIdleTime", func() {
+		BeforeEach(func() {
+			params := ex.DefaultClientPoolParams
+			params.MaxSize = 4
+			params.CheckClientFreq = time.Millisecond * 500
+			params.MaxClientIdleTime = time.Millisecond * 500
+			params.MinIdle = 2
+			pool = ex.NewClientPool(params)
+
+			clients = nil
+			for i := 0; i < 4; i++ {
+				c, err := pool.Get()
+				Expect(err).NotTo(HaveOccurred())
+				clients = append(clients, c)
+			}
+
+			for _, c := range clients {
+				Expect(pool.Return(c)).To(Succeed())
+			}
+		})
+
+		It("should keep MinIdle clients running and stop the excess", func() {
+			numRunning := func() int {
+				n := 0
+				for _, c := range clients {
+					if c.IsRunning() {
+						n++
+					}
+				}
+				return n
+			}
+
+			Eventually(numRunning, time.Second*10).Should(Equal(2))
+			Consistently(numRunning, time.Second*2).Should(Equal(2))
+		})
+	})
+})
+
+var _ = Describe("Pool client operation limit", func() {
+	var pool *ex.ClientPool
+
+	AfterEach(func() {
+		pool.Close()
+	})
+
+	When("a client has reached MaxClientOperations", func() {
+		var client *ex.Client
+
+		BeforeEach(func() {
+			params := ex.DefaultClientPoolParams
+			params.CheckClientFreq = time.Millisecond * 500
+			params.MaxClientOperations = 2
+			pool = ex.NewClientPool(params)
+
+			var err error
+			client, err = pool.Get()
+			Expect(err).NotTo(HaveOccurred())
+
+			for i := 0; i < 2; i++ {
+				_, err = client.List(ex.Args{}, ex.RodsItem{IPath: "/testZone"})
+				Expect(err).NotTo(HaveOccurred())
+			}
+
+			Expect(pool.Return(client)).To(Succeed())
+		})
+
+		It("should be retired", func() {
+			Eventually(client.IsRunning, time.Second*10).Should(BeFalse())
+		})
+	})
+
+	When("a client has not reached MaxClientOperations", func() {
+		var client *ex.Client
+
+		BeforeEach(func() {
+			params := ex.DefaultClientPoolParams
+			params.CheckClientFreq = time.Millisecond * 500
+			params.MaxClientOperations = 100
+			pool = ex.NewClientPool(params)
+
+			var err error
+			client, err = pool.Get()
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = client.List(ex.Args{}, ex.RodsItem{IPath: "/testZone"})
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(pool.Return(client)).To(Succeed())
+		})
+
+		It("should not be retired", func() {
+			Consistently(client.IsRunning, time.Second*2).Should(BeTrue())
+		})
+	})
+})
+
+var _ = Describe("Borrow a client from the pool", func() {
+	var pool *ex.ClientPool
+
+	BeforeEach(func() {
+		params := ex.DefaultClientPoolParams
+		params.MaxSize = 1
+		pool = ex.NewClientPool(params)
+	})
+
+	AfterEach(func() {
+		pool.Close()
+	})
+
+	// With a pool of size 1, Get will time out unless the borrowed client
+	// was returned
+	expectReturned := func() {
+		c, err := pool.Get()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(pool.Return(c)).To(Succeed())
+	}
+
+	When("the function succeeds", func() {
+		It("should return the client to the pool", func() {
+			err := pool.WithClient(func(c *ex.Client) error {
+				_, err := c.List(ex.Args{}, ex.RodsItem{IPath: "/testZone"})
+				return err
+			})
+			Expect(err).NotTo(HaveOccurred())
+			expectReturned()
+		})
+	})
+
+	When("the function returns an error", func() {
+		It("should return the error and the client to the pool", func() {
+			fnErr := errors.New("test error")
+			err := pool.WithClient(func(c *ex.Client) error {
+				return fnErr
+			})
+			Expect(err).To(MatchError(fnErr))
+			expectReturned()
+		})
+	})
+
+	When("the function panics", func() {
+		It("should return the client to the pool", func() {
+			Expect(func() {
+				_ = pool.WithClient(func(c *ex.Client) error {
+					panic("test panic")
+				})
+			}).To(PanicWith("test panic"))
+			expectReturned()
+		})
+	})
+})
+
+var _ = Describe("Warm and drain the pool", func() {
+	var pool *ex.ClientPool
+
+	BeforeEach(func() {
+		params := ex.DefaultClientPoolParams
+		params.MaxSize = 4
+		params.GetTimeout = time.Millisecond * 50
+		pool = ex.NewClientPool(params)
+	})
+
+	AfterEach(func() {
+		pool.Close()
+	})
+
+	When("the pool is warmed", func() {
+		It("should start no more clients than the maximum size", func() {
+			n, err := pool.Warm(context.Background(), 10)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(n).To(Equal(uint8(4)))
+		})
+
+		It("should provide started clients", func() {
+			n, err := pool.Warm(context.Background(), 2)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(n).To(Equal(uint8(2)))
+
+			c, err := pool.Get()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(c.IsRunning()).To(BeTrue())
+			Expect(pool.Return(c)).To(Succeed())
+		})
+	})
+
+	When("the pool is warmed under a tight deadline", func() {
+		It("should return a partial warm-up without error", func() {
+			ctx, cancel := context.WithTimeout(context.Background(),
+				time.Millisecond)
+			defer cancel()
+			<-ctx.Done()
+
+			n, err := pool.Warm(ctx, 4)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(n).To(BeNumerically("<", 4))
+		})
+	})
+
+	When("the pool is drained", func() {
+		var clients []*ex.Client
+
+		BeforeEach(func() {
+			_, err := pool.Warm(context.Background(), 4)
+			Expect(err).NotTo(HaveOccurred())
+
+			clients = nil
+			for i := 0; i < 4; i++ {
+				c, err := pool.Get()
+				Expect(err).NotTo(HaveOccurred())
+				clients = append(clients, c)
+			}
+		})
+
+		It("should stop idle clients and wait for clients in use", func() {
+			Expect(pool.Return(clients[0])).To(Succeed())
+
+			ctx, cancel := context.WithTimeout(context.Background(),
+				time.Millisecond*100)
+			defer cancel()
+
+			err := pool.Drain(ctx)
+			Expect(err).To(HaveOccurred())
+			Expect(errors.Is(err, context.DeadlineExceeded)).To(BeTrue())
+			Expect(clients[0].IsRunning()).To(BeFalse())
+
+			for _, c := range clients[1:] {
+				Expect(pool.Return(c)).To(Succeed())
+			}
+
+			Expect(pool.Drain(context.Background())).To(Succeed())
+			for _, c := range clients {
+				Expect(c.IsRunning()).To(BeFalse())
+			}
+		})
+	})
+})
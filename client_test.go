@@ -24,6 +24,7 @@ package extendo_test
 import (
 	"os"
 	"path/filepath"
+	"syscall"
 	"time"
 
 	. "github.com/onsi/ginkgo/v2"
@@ -111,8 +112,113 @@ var _ = Describe("Start and stop the Item client", func() {
 			It("should not be running", func() {
 				Expect(client.IsRunning()).To(BeFalse())
 			})
+
+			When("Stop is called again", func() {
+				It("should return the same result without panicking", func() {
+					Expect(func() {
+						Expect(client.Stop()).To(Equal(err))
+						Expect(client.Stop()).To(Equal(err))
+					}).NotTo(Panic())
+					Expect(client.IsRunning()).To(BeFalse())
+				})
+			})
+		})
+
+	})
+
+	Describe("Start in a process group", func() {
+		AfterEach(func() {
+			client.StopIgnoreError()
+		})
+
+		When("the client is started by default", func() {
+			It("should be in a different process group", func() {
+				pgid, err := syscall.Getpgid(client.ClientPid())
+				Expect(err).NotTo(HaveOccurred())
+				Expect(pgid).NotTo(Equal(syscall.Getpgrp()))
+			})
+		})
+
+		When("the client is started with the process group option off", func() {
+			BeforeEach(func() {
+				client.StopIgnoreError()
+
+				path, err := ex.FindBaton()
+				Expect(err).NotTo(HaveOccurred())
+				client, err = ex.NewClient(path)
+				Expect(err).NotTo(HaveOccurred())
+
+				client.SetProcessGroup(false)
+				_, err = client.Start(batonArgs...)
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			It("should be running in the same process group", func() {
+				Expect(client.IsRunning()).To(BeTrue())
+
+				pgid, err := syscall.Getpgid(client.ClientPid())
+				Expect(err).NotTo(HaveOccurred())
+				Expect(pgid).To(Equal(syscall.Getpgrp()))
+
+				_, err = client.List(ex.Args{}, ex.RodsItem{IPath: "/testZone"})
+				Expect(err).NotTo(HaveOccurred())
+			})
+		})
+	})
+
+	Describe("Count operations", func() {
+		AfterEach(func() {
+			client.StopIgnoreError()
+		})
+
+		When("the client has just started", func() {
+			It("should have performed no operations", func() {
+				Expect(client.OperationCount()).To(BeZero())
+			})
+		})
+
+		When("the client performs operations", func() {
+			It("should count one per operation", func() {
+				coll := ex.RodsItem{IPath: "/testZone"}
+				for i := 1; i <= 3; i++ {
+					_, err := client.List(ex.Args{}, coll)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(client.OperationCount()).To(Equal(uint64(i)))
+				}
+			})
 		})
+	})
+})
+
+var _ = Describe("Find the home collection of the iRODS user", func() {
+	var (
+		client *ex.Client
+		err    error
+	)
+
+	BeforeEach(func() {
+		client, err = ex.FindAndStart(batonArgs...)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		client.StopIgnoreError()
+	})
+
+	It("should report the user and zone", func() {
+		info, err := client.UserInfo()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(info).To(Equal(ex.UserInfo{User: "irods", Zone: "testZone"}))
+	})
+
+	It("should return the home collection", func() {
+		coll, err := client.HomeCollection()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(coll.RodsPath()).To(Equal("/testZone/home/irods"))
 
+		exists, err := coll.Exists()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(exists).To(BeTrue())
 	})
 })
 
@@ -260,6 +366,116 @@ var _ = Describe("List an iRODS path", func() {
 					Expect(items).To(WithTransform(getRodsPaths, ConsistOf(expectedItems)))
 				})
 			})
+
+			When("contents are recursed to a maximum depth", func() {
+				It("should return only the first level of contents for depth 1", func() {
+					items, err := client.List(ex.Args{Recurse: true, MaxDepth: 1},
+						testColl)
+					Expect(err).NotTo(HaveOccurred())
+
+					expectedItems := []string{
+						"testdata",
+						"testdata/1",
+						"testdata/testdir",
+					}
+
+					Expect(items).To(WithTransform(getRodsPaths, ConsistOf(expectedItems)))
+				})
+
+				It("should return two levels of contents for depth 2", func() {
+					items, err := client.List(ex.Args{Recurse: true, MaxDepth: 2},
+						testColl)
+					Expect(err).NotTo(HaveOccurred())
+
+					expectedItems := []string{
+						"testdata",
+						"testdata/1",
+						"testdata/1/reads",
+						"testdata/testdir",
+						"testdata/testdir/.gitignore",
+					}
+
+					Expect(items).To(WithTransform(getRodsPaths, ConsistOf(expectedItems)))
+				})
+			})
+
+			When("a tree is requested", func() {
+				It("should return a tree with the same hierarchy", func() {
+					root, err := client.ListTree(ex.Args{}, testColl)
+					Expect(err).NotTo(HaveOccurred())
+
+					pathOf := func(node *ex.CollNode) string {
+						return node.Collection.RodsPath()
+					}
+
+					Expect(pathOf(root)).To(Equal(testColl.RodsPath()))
+					Expect(root.DataObjects).To(BeEmpty())
+					Expect(root.Collections).To(HaveLen(2))
+
+					one, testdir := root.Collections[0], root.Collections[1]
+					Expect(pathOf(one)).To(Equal(filepath.Join(testColl.IPath, "1")))
+					Expect(pathOf(testdir)).To(Equal(filepath.Join(testColl.IPath, "testdir")))
+					Expect(testdir.DataObjects).To(WithTransform(getRodsPaths,
+						ConsistOf("testdata/testdir/.gitignore")))
+
+					Expect(one.Collections).To(HaveLen(1))
+					reads := one.Collections[0]
+					Expect(reads.Collections).To(HaveLen(2))
+
+					fast5, fastq := reads.Collections[0], reads.Collections[1]
+					Expect(fast5.DataObjects).To(WithTransform(getRodsPaths,
+						ConsistOf(
+							"testdata/1/reads/fast5/reads1.fast5",
+							"testdata/1/reads/fast5/reads1.fast5.md5",
+							"testdata/1/reads/fast5/reads2.fast5",
+							"testdata/1/reads/fast5/reads3.fast5")))
+					Expect(fastq.DataObjects).To(WithTransform(getRodsPaths,
+						ConsistOf(
+							"testdata/1/reads/fastq/reads1.fastq",
+							"testdata/1/reads/fastq/reads1.fastq.md5",
+							"testdata/1/reads/fastq/reads2.fastq",
+							"testdata/1/reads/fastq/reads3.fastq")))
+				})
+			})
+		})
+
+		Context("items of one type are requested", func() {
+			var all []ex.RodsItem
+
+			BeforeEach(func() {
+				all, err = client.List(ex.Args{Recurse: true}, testColl)
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			It("should return only collections", func() {
+				var expected []ex.RodsItem
+				for _, item := range all {
+					if item.IsCollection() {
+						expected = append(expected, item)
+					}
+				}
+
+				colls, err := client.ListCollections(ex.Args{Recurse: true}, testColl)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(colls).NotTo(BeEmpty())
+				Expect(colls).To(WithTransform(getRodsPaths,
+					ConsistOf(getRodsPaths(expected))))
+			})
+
+			It("should return only data objects", func() {
+				var expected []ex.RodsItem
+				for _, item := range all {
+					if item.IsDataObject() {
+						expected = append(expected, item)
+					}
+				}
+
+				objs, err := client.ListDataObjects(ex.Args{Recurse: true}, testColl)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(objs).NotTo(BeEmpty())
+				Expect(objs).To(WithTransform(getRodsPaths,
+					ConsistOf(getRodsPaths(expected))))
+			})
 		})
 
 		Context("a single item is requested", func() {
@@ -446,6 +662,223 @@ var _ = Describe("List an iRODS path", func() {
 	})
 })
 
+var _ = Describe("List a relative iRODS path", func() {
+	var (
+		client *ex.Client
+		err    error
+
+		rootColl, workColl string
+	)
+
+	BeforeEach(func() {
+		client, err = ex.FindAndStart(batonArgs...)
+		Expect(err).NotTo(HaveOccurred())
+
+		rootColl = "/testZone/home/irods"
+		workColl = tmpRodsPath(rootColl, "ExtendoWorkingColl")
+
+		err = putTestData("testdata/", workColl)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		err = removeTmpCollection(workColl)
+		Expect(err).NotTo(HaveOccurred())
+
+		client.StopIgnoreError()
+	})
+
+	When("a working collection is set", func() {
+		BeforeEach(func() {
+			err = client.SetWorkingCollection(workColl)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("should resolve a relative collection path", func() {
+			item, err := client.ListItem(ex.Args{},
+				ex.RodsItem{IPath: "testdata/1"})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(item.RodsPath()).To(Equal(filepath.Join(workColl, "testdata/1")))
+		})
+
+		It("should resolve a relative data object path", func() {
+			item, err := client.ListItem(ex.Args{},
+				ex.RodsItem{IPath: "testdata/1/reads/fast5", IName: "reads1.fast5"})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(item.RodsPath()).To(Equal(filepath.Join(workColl,
+				"testdata/1/reads/fast5/reads1.fast5")))
+		})
+
+		It("should not change an absolute path", func() {
+			item, err := client.ListItem(ex.Args{},
+				ex.RodsItem{IPath: rootColl})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(item.RodsPath()).To(Equal(rootColl))
+		})
+	})
+
+	When("the working collection is relative", func() {
+		It("should return an error", func() {
+			err = client.SetWorkingCollection("testZone/home")
+			Expect(err).To(HaveOccurred())
+			Expect(client.WorkingCollection()).To(BeEmpty())
+		})
+	})
+})
+
+var _ = Describe("Make an item from an iRODS path", func() {
+	var (
+		client *ex.Client
+		err    error
+
+		rootColl, workColl string
+	)
+
+	BeforeEach(func() {
+		client, err = ex.FindAndStart(batonArgs...)
+		Expect(err).NotTo(HaveOccurred())
+
+		rootColl = "/testZone/home/irods"
+		workColl = tmpRodsPath(rootColl, "ExtendoItemFromPath")
+
+		err = putTestData("testdata/", workColl)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		err = removeTmpCollection(workColl)
+		Expect(err).NotTo(HaveOccurred())
+
+		client.StopIgnoreError()
+	})
+
+	When("the path is a collection", func() {
+		It("should return a collection", func() {
+			path := filepath.Join(workColl, "testdata/1/reads")
+			item, err := client.ItemFromPath(path)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(item.IsCollection()).To(BeTrue())
+			Expect(item.RodsPath()).To(Equal(path))
+		})
+	})
+
+	When("the path is a data object", func() {
+		It("should return a data object", func() {
+			path := filepath.Join(workColl, "testdata/1/reads/fast5/reads1.fast5")
+			item, err := client.ItemFromPath(path)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(item.IsDataObject()).To(BeTrue())
+			Expect(item.IName).To(Equal("reads1.fast5"))
+			Expect(item.RodsPath()).To(Equal(path))
+		})
+	})
+
+	When("the path does not exist", func() {
+		It("should return an error", func() {
+			_, err := client.ItemFromPath(filepath.Join(workColl, "does_not_exist"))
+			Expect(err).To(HaveOccurred())
+			code, err := ex.RodsErrorCode(err)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(code).To(Equal(ex.RodsUserFileDoesNotExist))
+		})
+	})
+})
+
+var _ = Describe("Describe an item in iRODS", func() {
+	var (
+		client *ex.Client
+		err    error
+
+		rootColl, workColl string
+	)
+
+	BeforeEach(func() {
+		client, err = ex.FindAndStart(batonArgs...)
+		Expect(err).NotTo(HaveOccurred())
+
+		rootColl = "/testZone/home/irods"
+		workColl = tmpRodsPath(rootColl, "ExtendoDescribe")
+
+		err = putTestData("testdata/", workColl)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		err = removeTmpCollection(workColl)
+		Expect(err).NotTo(HaveOccurred())
+
+		client.StopIgnoreError()
+	})
+
+	When("the item is a data object", func() {
+		It("should have all its details", func() {
+			item := ex.RodsItem{
+				IPath: filepath.Join(workColl, "testdata/1/reads/fast5"),
+				IName: "reads1.fast5"}
+
+			described, err := client.Describe(item)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(described.IChecksum).To(Equal("1181c1834012245d785120e3505ed169"))
+			Expect(described.ISize).To(BeNumerically(">", 0))
+			Expect(described.IReplicates).NotTo(BeEmpty())
+			Expect(described.ITimestamps).NotTo(BeEmpty())
+			Expect(described.IACLs).NotTo(BeEmpty())
+		})
+	})
+})
+
+var _ = Describe("Remove an item from iRODS", func() {
+	var (
+		client *ex.Client
+		err    error
+
+		rootColl, workColl string
+	)
+
+	BeforeEach(func() {
+		client, err = ex.FindAndStart(batonArgs...)
+		Expect(err).NotTo(HaveOccurred())
+
+		rootColl = "/testZone/home/irods"
+		workColl = tmpRodsPath(rootColl, "ExtendoRemoveItem")
+
+		err = putTestData("testdata/", workColl)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		err = removeTmpCollection(workColl)
+		Expect(err).NotTo(HaveOccurred())
+
+		client.StopIgnoreError()
+	})
+
+	When("the item is a data object", func() {
+		It("should be removed", func() {
+			path := filepath.Join(workColl, "testdata/1/reads/fast5/reads1.fast5")
+			item, err := client.ItemFromPath(path)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(item.Remove()).To(Succeed())
+			Expect(item.Exists()).To(BeFalse())
+		})
+	})
+
+	When("the item is an empty collection", func() {
+		It("should be removed", func() {
+			path := filepath.Join(workColl, "empty")
+			_, err = client.MkDir(ex.Args{}, ex.RodsItem{IPath: path})
+			Expect(err).NotTo(HaveOccurred())
+
+			item, err := client.ItemFromPath(path)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(item.Remove()).To(Succeed())
+			Expect(item.Exists()).To(BeFalse())
+		})
+	})
+})
+
 var _ = Describe("Put a file into iRODS", func() {
 	var (
 		client *ex.Client
@@ -576,51 +1009,222 @@ var _ = Describe("Put a directory into iRODS", func() {
 		})
 	})
 
-	When("a local directory is put into iRODS, with recursion", func() {
-		AfterEach(func() {
-			err = removeTmpCollection(workColl)
+	When("a local directory is put into iRODS, with recursion", func() {
+		AfterEach(func() {
+			err = removeTmpCollection(workColl)
+			Expect(err).NotTo(HaveOccurred())
+
+			client.StopIgnoreError()
+		})
+
+		It("should create a tree, including data objects", func() {
+			testItem := ex.RodsItem{IDirectory: "testdata", IPath: workColl}
+			Expect(testItem.IsLocalDir()).To(BeTrue())
+			Expect(testItem.IsCollection()).To(BeTrue())
+			Expect(testItem.IsLocalFile()).To(BeFalse())
+			Expect(testItem.IsDataObject()).To(BeFalse())
+
+			items, err := client.Put(ex.Args{Recurse: true}, testItem)
+			Expect(err).NotTo(HaveOccurred())
+
+			expectedItems := []string{
+				"testdata/1/reads/fast5/reads1.fast5",
+				"testdata/1/reads/fast5/reads1.fast5.md5",
+				"testdata/1/reads/fast5/reads2.fast5",
+				"testdata/1/reads/fast5/reads3.fast5",
+				"testdata/1/reads/fastq/reads1.fastq",
+				"testdata/1/reads/fastq/reads1.fastq.md5",
+				"testdata/1/reads/fastq/reads2.fastq",
+				"testdata/1/reads/fastq/reads3.fastq",
+				"testdata/testdir/.gitignore",
+			}
+			Expect(items).To(WithTransform(getRodsPaths,
+				ConsistOf(expectedItems)))
+
+			expectedFiles := []string{
+				"1/reads/fast5/reads1.fast5",
+				"1/reads/fast5/reads1.fast5.md5",
+				"1/reads/fast5/reads2.fast5",
+				"1/reads/fast5/reads3.fast5",
+				"1/reads/fastq/reads1.fastq",
+				"1/reads/fastq/reads1.fastq.md5",
+				"1/reads/fastq/reads2.fastq",
+				"1/reads/fastq/reads3.fastq",
+				"testdir/.gitignore",
+			}
+			Expect(items).To(WithTransform(getLocalPaths,
+				ConsistOf(expectedFiles)))
+		})
+
+		It("should create the same tree from an absolute local path", func() {
+			absPath, err := filepath.Abs("testdata")
+			Expect(err).NotTo(HaveOccurred())
+
+			relColl := filepath.Join(workColl, "rel")
+			absColl := filepath.Join(workColl, "abs")
+
+			for _, coll := range []string{relColl, absColl} {
+				_, err = client.MkDir(ex.Args{Recurse: true},
+					ex.RodsItem{IPath: coll})
+				Expect(err).NotTo(HaveOccurred())
+			}
+
+			relItems, err := client.Put(ex.Args{Recurse: true},
+				ex.RodsItem{IDirectory: "testdata", IPath: relColl})
+			Expect(err).NotTo(HaveOccurred())
+
+			absItems, err := client.Put(ex.Args{Recurse: true},
+				ex.RodsItem{IDirectory: absPath, IPath: absColl})
+			Expect(err).NotTo(HaveOccurred())
+
+			getRelPaths := makeRodsItemTransform(relColl)
+			getAbsPaths := makeRodsItemTransform(absColl)
+
+			Expect(absItems).NotTo(BeEmpty())
+			Expect(absItems).To(WithTransform(getAbsPaths,
+				ConsistOf(getRelPaths(relItems))))
+		})
+	})
+
+	When("a local directory with an empty sub-directory is put into iRODS", func() {
+		var localDir string
+
+		BeforeEach(func() {
+			localDir, err = os.MkdirTemp("", "ExtendoPutEmpty")
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(os.MkdirAll(filepath.Join(localDir, "full"), 0700)).To(Succeed())
+			Expect(os.MkdirAll(filepath.Join(localDir, "empty"), 0700)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(localDir, "full", "x.txt"),
+				[]byte("x"), 0600)).To(Succeed())
+
+			_, err = client.MkDir(ex.Args{Recurse: true}, ex.RodsItem{IPath: workColl})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			Expect(os.RemoveAll(localDir)).To(Succeed())
+
+			err = removeTmpCollection(workColl)
+			Expect(err).NotTo(HaveOccurred())
+
+			client.StopIgnoreError()
+		})
+
+		It("should not create the empty collection by default", func() {
+			_, err := client.Put(ex.Args{Recurse: true},
+				ex.RodsItem{IDirectory: localDir, IPath: workColl})
+			Expect(err).NotTo(HaveOccurred())
+
+			empty := ex.NewCollection(client,
+				filepath.Join(workColl, filepath.Base(localDir), "empty"))
+			Expect(empty.Exists()).To(BeFalse())
+		})
+
+		It("should create the empty collection when requested", func() {
+			items, err := client.Put(ex.Args{Recurse: true, EmptyDirs: true},
+				ex.RodsItem{IDirectory: localDir, IPath: workColl})
+			Expect(err).NotTo(HaveOccurred())
+
+			emptyPath := filepath.Join(workColl, filepath.Base(localDir), "empty")
+			Expect(items).To(WithTransform(func(items []ex.RodsItem) []string {
+				var paths []string
+				for _, item := range items {
+					paths = append(paths, item.RodsPath())
+				}
+				return paths
+			}, ContainElement(emptyPath)))
+
+			empty := ex.NewCollection(client, emptyPath)
+			Expect(empty.Exists()).To(BeTrue())
+			Expect(empty.FetchContents()).To(BeEmpty())
+		})
+	})
+})
+
+var _ = Describe("Put files into iRODS from a manifest", func() {
+	var (
+		client *ex.Client
+		err    error
+
+		rootColl, workColl string
+		entries            []ex.PutEntry
+
+		getRodsPaths itemPathTransform
+	)
+
+	BeforeEach(func() {
+		client, err = ex.FindAndStart(batonArgs...)
+		Expect(err).NotTo(HaveOccurred())
+
+		rootColl = "/testZone/home/irods"
+		workColl = tmpRodsPath(rootColl, "ExtendoPutManifest")
+		getRodsPaths = makeRodsItemTransform(workColl)
+
+		entries = []ex.PutEntry{
+			{
+				LocalPath:  "testdata/1/reads/fast5/reads1.fast5",
+				RemotePath: filepath.Join(workColl, "a/reads1.fast5"),
+				Checksum:   "1181c1834012245d785120e3505ed169",
+				AVUs:       []ex.AVU{{Attr: "test_attr_a", Value: "1"}},
+			},
+			{
+				LocalPath:  "testdata/1/reads/fastq/reads1.fastq",
+				RemotePath: filepath.Join(workColl, "b/c/reads1.fastq"),
+				AVUs: []ex.AVU{{Attr: "test_attr_a", Value: "2"},
+					{Attr: "test_attr_b", Value: "3"}},
+			},
+			{
+				LocalPath:  "testdata/1/reads/fastq/reads2.fastq",
+				RemotePath: filepath.Join(workColl, "b/c/reads2.fastq"),
+			},
+		}
+	})
+
+	AfterEach(func() {
+		err = removeTmpCollection(workColl)
+		Expect(err).NotTo(HaveOccurred())
+
+		client.StopIgnoreError()
+	})
+
+	When("a manifest is put into iRODS", func() {
+		It("should create all the data objects, with their metadata", func() {
+			items, err := client.PutManifest(entries)
 			Expect(err).NotTo(HaveOccurred())
+			Expect(items).To(WithTransform(getRodsPaths,
+				Equal([]string{"a/reads1.fast5", "b/c/reads1.fastq",
+					"b/c/reads2.fastq"})))
 
-			client.StopIgnoreError()
-		})
+			for i, entry := range entries {
+				obj := ex.NewDataObject(client, entry.RemotePath)
+				avus, err := obj.FetchMetadata()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(avus).To(ConsistOf(entry.AVUs))
+				Expect(items[i].Metadata()).To(ConsistOf(entry.AVUs))
+			}
 
-		It("should create a tree, including data objects", func() {
-			testItem := ex.RodsItem{IDirectory: "testdata", IPath: workColl}
-			Expect(testItem.IsLocalDir()).To(BeTrue())
-			Expect(testItem.IsCollection()).To(BeTrue())
-			Expect(testItem.IsLocalFile()).To(BeFalse())
-			Expect(testItem.IsDataObject()).To(BeFalse())
+			Expect(items[0].IChecksum).To(Equal(entries[0].Checksum))
+		})
+	})
 
-			items, err := client.Put(ex.Args{Recurse: true}, testItem)
-			Expect(err).NotTo(HaveOccurred())
+	When("an entry's checksum does not match", func() {
+		BeforeEach(func() {
+			entries[0].Checksum = "00000000000000000000000000000000"
+		})
 
-			expectedItems := []string{
-				"testdata/1/reads/fast5/reads1.fast5",
-				"testdata/1/reads/fast5/reads1.fast5.md5",
-				"testdata/1/reads/fast5/reads2.fast5",
-				"testdata/1/reads/fast5/reads3.fast5",
-				"testdata/1/reads/fastq/reads1.fastq",
-				"testdata/1/reads/fastq/reads1.fastq.md5",
-				"testdata/1/reads/fastq/reads2.fastq",
-				"testdata/1/reads/fastq/reads3.fastq",
-				"testdata/testdir/.gitignore",
-			}
-			Expect(items).To(WithTransform(getRodsPaths,
-				ConsistOf(expectedItems)))
+		It("should return an error, after putting the other entries", func() {
+			items, err := client.PutManifest(entries)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("failed to put 1 of 3 items"))
+			Expect(items).To(HaveLen(3))
 
-			expectedFiles := []string{
-				"1/reads/fast5/reads1.fast5",
-				"1/reads/fast5/reads1.fast5.md5",
-				"1/reads/fast5/reads2.fast5",
-				"1/reads/fast5/reads3.fast5",
-				"1/reads/fastq/reads1.fastq",
-				"1/reads/fastq/reads1.fastq.md5",
-				"1/reads/fastq/reads2.fastq",
-				"1/reads/fastq/reads3.fastq",
-				"testdir/.gitignore",
+			for _, entry := range entries[1:] {
+				obj := ex.NewDataObject(client, entry.RemotePath)
+				exists, err := obj.Exists()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(exists).To(BeTrue())
 			}
-			Expect(items).To(WithTransform(getLocalPaths,
-				ConsistOf(expectedFiles)))
 		})
 	})
 })
@@ -679,6 +1283,54 @@ var _ = Describe("Remove a data object from iRODS", func() {
 			Expect(code).To(Equal(ex.RodsUserFileDoesNotExist))
 		})
 	})
+
+	Context("when the zone has trash enabled", func() {
+		var trashObj ex.RodsItem
+
+		BeforeEach(func() {
+			testObj = ex.RodsItem{
+				IPath: filepath.Join(workColl, "testdata/1/reads/fast5"),
+				IName: "reads1.fast5"}
+
+			// The trash mirrors the layout of the zone home collections
+			rel, err := filepath.Rel("/testZone/home", testObj.IPath)
+			Expect(err).NotTo(HaveOccurred())
+
+			trashObj = ex.RodsItem{
+				IPath: filepath.Join("/testZone/trash/home", rel),
+				IName: testObj.IName}
+		})
+
+		AfterEach(func() {
+			trashColl := ex.RodsItem{IPath: trashObj.IPath}
+			_, _ = client.RemDir(ex.Args{Force: true, Recurse: true}, trashColl)
+		})
+
+		When("a data object is removed without force", func() {
+			It("should be recoverable from the trash", func() {
+				_, err = client.RemObj(ex.Args{}, testObj)
+				Expect(err).NotTo(HaveOccurred())
+
+				item, err := client.ListItem(ex.Args{}, trashObj)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(item.RodsPath()).To(Equal(trashObj.RodsPath()))
+			})
+		})
+
+		When("a data object is removed with force", func() {
+			It("should not be in the trash", func() {
+				_, err = client.RemObj(ex.Args{Force: true}, testObj)
+				Expect(err).NotTo(HaveOccurred())
+
+				_, err := client.ListItem(ex.Args{}, trashObj)
+				Expect(err).To(HaveOccurred())
+
+				code, e := ex.RodsErrorCode(err)
+				Expect(e).NotTo(HaveOccurred())
+				Expect(code).To(Equal(ex.RodsUserFileDoesNotExist))
+			})
+		})
+	})
 })
 
 var _ = Describe("Remove an iRODS collection", func() {
@@ -838,6 +1490,32 @@ var _ = Describe("Calculate a data object checksum", func() {
 			Expect(checksum).To(Equal(testChecksum))
 		})
 	})
+
+	When("the checksum of a data object that does not exist is listed", func() {
+		It("should report that the data object does not exist", func() {
+			_, err := client.ListChecksum(testObj)
+			Expect(err).To(MatchError(ContainSubstring(
+				"failed to read the checksum of " + testObj.RodsPath() +
+					" because the data object does not exist")))
+
+			code, err := ex.RodsErrorCode(err)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(code).To(Equal(ex.RodsUserFileDoesNotExist))
+		})
+	})
+
+	When("a healthy data object's checksum is verified", func() {
+		It("should match the recomputed checksum", func() {
+			_, err := client.Put(ex.Args{Checksum: true}, testObj)
+			Expect(err).NotTo(HaveOccurred())
+
+			match, stored, recomputed, err := client.VerifyObjectChecksum(testObj)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(match).To(BeTrue())
+			Expect(stored).To(Equal(testChecksum))
+			Expect(recomputed).To(Equal(testChecksum))
+		})
+	})
 })
 
 var _ = Describe("Add access permissions", func() {
@@ -895,6 +1573,25 @@ var _ = Describe("Add access permissions", func() {
 		})
 	})
 
+	Context("setting permissions on collections recursively", func() {
+		When("adding access for a group", func() {
+			It("should add an ACL to all nested items", func() {
+				testColl.IACLs = []ex.ACL{publicRead}
+				paths, err := client.ChmodRecurse(testColl)
+				Expect(err).NotTo(HaveOccurred())
+
+				items, err := client.List(ex.Args{ACL: true, Recurse: true}, testColl)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(paths).To(HaveLen(len(items)))
+
+				for _, item := range items[1:] {
+					Expect(item.IACLs).To(ContainElement(publicRead))
+				}
+				Expect(paths).To(ContainElement(testObj.RodsPath()))
+			})
+		})
+	})
+
 	Context("setting permissions on data objects", func() {
 		When("adding access for a group", func() {
 			It("should add an ACL", func() {
@@ -916,6 +1613,64 @@ var _ = Describe("Add access permissions", func() {
 	})
 })
 
+var _ = Describe("Copy access permissions", func() {
+	var (
+		client *ex.Client
+		err    error
+
+		rootColl, workColl string
+		srcColl, dstColl   ex.RodsItem
+
+		publicRead = ex.ACL{Owner: "public", Level: "read", Zone: "testZone"}
+	)
+
+	BeforeEach(func() {
+		client, err = ex.FindAndStart(batonArgs...)
+		Expect(err).NotTo(HaveOccurred())
+
+		rootColl = "/testZone/home/irods"
+		workColl = tmpRodsPath(rootColl, "ExtendoCopyACLs")
+
+		srcColl = ex.RodsItem{IPath: filepath.Join(workColl, "src")}
+		dstColl = ex.RodsItem{IPath: filepath.Join(workColl, "dst")}
+		for _, coll := range []ex.RodsItem{srcColl, dstColl} {
+			_, err = client.MkDir(ex.Args{Recurse: true}, coll)
+			Expect(err).NotTo(HaveOccurred())
+		}
+
+		src := ex.CopyRodsItem(srcColl)
+		src.IACLs = []ex.ACL{publicRead}
+		_, err = client.Chmod(ex.Args{}, src)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		err = removeTmpCollection(workColl)
+		Expect(err).NotTo(HaveOccurred())
+
+		client.StopIgnoreError()
+	})
+
+	When("ACLs are copied from one collection to another", func() {
+		It("should give the target the same ACLs", func() {
+			item, err := client.ListItem(ex.Args{ACL: true}, dstColl)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(item.IACLs).NotTo(ContainElement(publicRead))
+
+			err = client.CopyACLs(srcColl, dstColl)
+			Expect(err).NotTo(HaveOccurred())
+
+			src, err := client.ListItem(ex.Args{ACL: true}, srcColl)
+			Expect(err).NotTo(HaveOccurred())
+			dst, err := client.ListItem(ex.Args{ACL: true}, dstColl)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(dst.IACLs).To(ContainElement(publicRead))
+			Expect(dst.IACLs).To(ConsistOf(src.IACLs))
+		})
+	})
+})
+
 var _ = Describe("Remove access permissions", func() {
 	var (
 		client *ex.Client
@@ -1100,6 +1855,208 @@ var _ = Describe("Metadata query", func() {
 			})
 		})
 	})
+
+	Context("querying under a collection", func() {
+		BeforeEach(func() {
+			testColl := ex.RodsItem{
+				IPath: filepath.Join(workColl, "testdata")}
+			items, err := client.List(ex.Args{Recurse: true}, testColl)
+			Expect(err).NotTo(HaveOccurred())
+
+			for _, item := range items {
+				item.IAVUs = []ex.AVU{{Attr: "test_attr_u", Value: "1"}}
+				_, err = client.MetaAdd(ex.Args{}, item)
+				Expect(err).NotTo(HaveOccurred())
+			}
+		})
+
+		When("a query is run", func() {
+			It("should return only data objects within the collection", func() {
+				items, err := client.MetaQueryUnder(
+					filepath.Join(workColl, "testdata/1/reads/fastq"),
+					ex.Args{Object: true},
+					ex.RodsItem{IAVUs: []ex.AVU{{Attr: "test_attr_u", Value: "1"}}})
+				Expect(err).NotTo(HaveOccurred())
+
+				expectedItems := []string{
+					"testdata/1/reads/fastq/reads1.fastq",
+					"testdata/1/reads/fastq/reads1.fastq.md5",
+					"testdata/1/reads/fastq/reads2.fastq",
+					"testdata/1/reads/fastq/reads3.fastq",
+				}
+
+				Expect(items).To(WithTransform(getRodsPaths,
+					ConsistOf(expectedItems)))
+			})
+		})
+	})
+
+	Context("removing metadata from query results", func() {
+		var tag = ex.AVU{Attr: "test_attr_study", Value: "1"}
+		var query ex.RodsItem
+
+		BeforeEach(func() {
+			testColl := ex.RodsItem{
+				IPath: filepath.Join(workColl, "testdata/1/reads")}
+			items, err := client.ListDataObjects(ex.Args{Recurse: true}, testColl)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(items).NotTo(BeEmpty())
+
+			for _, item := range items {
+				item.IAVUs = []ex.AVU{tag}
+				_, err = client.MetaAdd(ex.Args{}, item)
+				Expect(err).NotTo(HaveOccurred())
+			}
+
+			query = ex.RodsItem{IAVUs: []ex.AVU{tag}}
+			items, err = client.MetaQueryUnder(workColl, ex.Args{Object: true}, query)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(items).NotTo(BeEmpty())
+		})
+
+		When("using a client", func() {
+			It("should remove the AVUs from all the results", func() {
+				query.IPath = workColl
+				err := client.RemoveMetadataFromQuery(ex.Args{Object: true},
+					query, []ex.AVU{tag})
+				Expect(err).NotTo(HaveOccurred())
+
+				items, err := client.MetaQueryUnder(workColl,
+					ex.Args{Object: true}, query)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(items).To(BeEmpty())
+			})
+		})
+
+		When("using a client pool", func() {
+			It("should remove the AVUs from all the results", func() {
+				pool := ex.NewClientPool(ex.DefaultClientPoolParams)
+				defer pool.Close()
+
+				query.IPath = workColl
+				err := pool.RemoveMetadataFromQuery(ex.Args{Object: true},
+					query, []ex.AVU{tag})
+				Expect(err).NotTo(HaveOccurred())
+
+				items, err := client.MetaQueryUnder(workColl,
+					ex.Args{Object: true}, query)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(items).To(BeEmpty())
+			})
+		})
+	})
+
+	Context("setting ACLs on query results", func() {
+		var tag = ex.AVU{Attr: "test_attr_study", Value: "2"}
+		var publicRead = ex.ACL{Owner: "public", Level: "read", Zone: "testZone"}
+		var query ex.RodsItem
+
+		BeforeEach(func() {
+			testColl := ex.RodsItem{
+				IPath: filepath.Join(workColl, "testdata/1/reads")}
+			items, err := client.ListDataObjects(ex.Args{Recurse: true}, testColl)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(items).NotTo(BeEmpty())
+
+			for _, item := range items {
+				item.IAVUs = []ex.AVU{tag}
+				_, err = client.MetaAdd(ex.Args{}, item)
+				Expect(err).NotTo(HaveOccurred())
+			}
+
+			query = ex.RodsItem{IPath: workColl, IAVUs: []ex.AVU{tag}}
+		})
+
+		expectPublicRead := func() {
+			items, err := client.MetaQueryUnder(workColl,
+				ex.Args{Object: true, ACL: true}, query)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(items).NotTo(BeEmpty())
+
+			for _, item := range items {
+				Expect(item.IACLs).To(ContainElement(publicRead))
+			}
+		}
+
+		When("using a client", func() {
+			It("should set the ACLs on all the results", func() {
+				err := client.ChmodQueryResults(ex.Args{Object: true},
+					query, []ex.ACL{publicRead})
+				Expect(err).NotTo(HaveOccurred())
+				expectPublicRead()
+			})
+		})
+
+		When("using a client pool", func() {
+			It("should set the ACLs on all the results", func() {
+				pool := ex.NewClientPool(ex.DefaultClientPoolParams)
+				defer pool.Close()
+
+				err := pool.ChmodQueryResults(ex.Args{Object: true},
+					query, []ex.ACL{publicRead})
+				Expect(err).NotTo(HaveOccurred())
+				expectPublicRead()
+			})
+		})
+	})
+
+	Context("querying with units", func() {
+		var withUnits, withoutUnits ex.RodsItem
+
+		BeforeEach(func() {
+			withUnits = ex.RodsItem{
+				IPath: filepath.Join(workColl, "testdata/1/reads/fast5"),
+				IName: "reads1.fast5",
+				IAVUs: []ex.AVU{{Attr: "test_attr_l", Value: "100", Units: "bp"}}}
+			_, err = client.MetaAdd(ex.Args{}, withUnits)
+			Expect(err).NotTo(HaveOccurred())
+
+			withoutUnits = ex.RodsItem{
+				IPath: filepath.Join(workColl, "testdata/1/reads/fast5"),
+				IName: "reads2.fast5",
+				IAVUs: []ex.AVU{{Attr: "test_attr_l", Value: "100"}}}
+			_, err = client.MetaAdd(ex.Args{}, withoutUnits)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		When("units are not matched", func() {
+			It("should return items regardless of units", func() {
+				items, err := client.MetaQuery(ex.Args{Object: true},
+					ex.RodsItem{IAVUs: []ex.AVU{{Attr: "test_attr_l",
+						Value: "100", Units: "bp"}}})
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(items).To(WithTransform(getRodsPaths, ConsistOf(
+					"testdata/1/reads/fast5/reads1.fast5",
+					"testdata/1/reads/fast5/reads2.fast5")))
+			})
+		})
+
+		When("units are matched", func() {
+			It("should return only items having those units", func() {
+				items, err := client.MetaQuery(
+					ex.Args{Object: true, MatchUnits: true},
+					ex.RodsItem{IAVUs: []ex.AVU{{Attr: "test_attr_l",
+						Value: "100", Units: "bp"}}})
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(items).To(WithTransform(getRodsPaths, ConsistOf(
+					"testdata/1/reads/fast5/reads1.fast5")))
+				Expect(items[0].IAVUs).To(BeEmpty())
+			})
+
+			It("should return only items without units when none are given", func() {
+				items, err := client.MetaQuery(
+					ex.Args{Object: true, MatchUnits: true},
+					ex.RodsItem{IAVUs: []ex.AVU{{Attr: "test_attr_l",
+						Value: "100"}}})
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(items).To(WithTransform(getRodsPaths, ConsistOf(
+					"testdata/1/reads/fast5/reads2.fast5")))
+			})
+		})
+	})
 })
 
 var _ = Describe("Add metadata", func() {
@@ -1157,6 +2114,20 @@ var _ = Describe("Add metadata", func() {
 		})
 	})
 
+	Context("adding invalid metadata", func() {
+		When("adding an AVU with an embedded newline", func() {
+			It("should be rejected", func() {
+				testObj.IAVUs = []ex.AVU{{Attr: "abcdefgh", Value: "1234\n5678"}}
+				_, err = client.MetaAdd(ex.Args{}, testObj)
+				Expect(err).To(MatchError(MatchRegexp(`control character`)))
+
+				item, err := client.ListItem(ex.Args{AVU: true}, testObj)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(item.IAVUs).To(BeEmpty())
+			})
+		})
+	})
+
 	Context("adding metadata to data objects", func() {
 		When("adding an AVU", func() {
 			It("should be added", func() {
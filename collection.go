@@ -21,7 +21,11 @@
 package extendo
 
 import (
+	"os"
+	"path"
 	"path/filepath"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/pkg/errors"
@@ -33,15 +37,28 @@ type Collection struct {
 }
 
 // NewCollection makes a new instance, given a path in iRODS (existing, or not).
+// The path is cleaned, so that trailing and repeated slashes are removed and
+// any "." and ".." elements are resolved lexically. iRODS has no "." or ".."
+// collections. A path whose ".." elements would leave its leading zone
+// collection e.g. "/testZone/../home" is not cleaned, because the result would
+// be in a different zone; every operation on such a collection returns an
+// error.
 func NewCollection(client *Client, remotePath string) *Collection {
-	remotePath = filepath.Clean(remotePath)
+	if !leavesZone(remotePath) {
+		remotePath = filepath.Clean(remotePath)
+	}
 
 	return &Collection{&RodsItem{client: client, IPath: remotePath}}
 }
 
 // MakeCollection creates a new collection in iRODS and returns an instance. It
-// will create any leading collections as required.
+// will create any leading collections as required. It returns an error if the
+// path leaves its leading zone collection, as described for NewCollection.
 func MakeCollection(client *Client, remotePath string) (*Collection, error) {
+	if leavesZone(remotePath) {
+		return nil, errors.Errorf("cannot make collection '%s': the path "+
+			"leaves its zone", remotePath)
+	}
 	remotePath = filepath.Clean(remotePath)
 
 	item, err := client.MkDir(Args{Recurse: true}, RodsItem{IPath: remotePath})
@@ -124,20 +141,144 @@ func PutCollection(client *Client, localPath string, remotePath string,
 	return coll, err
 }
 
-func (coll *Collection) Ensure() error {
-	exists, err := coll.Exists()
+// PutDirectoryOpts are the options for Collection.PutDirectory.
+type PutDirectoryOpts struct {
+	// Pool, if set, provides Clients to put data objects concurrently, using up
+	// to the pool's maximum number of Clients. Otherwise, the data objects are
+	// put one at a time, using the collection's Client.
+	Pool *ClientPool
+	// Progress, if set, is called after each data object is put, with the data
+	// object, the number put so far and the total number to put. It is not
+	// called concurrently.
+	Progress func(obj RodsItem, done int, total int)
+}
+
+// PutDirectory puts the local directory localPath into the collection,
+// recursively, as a sub-collection named for the last element of localPath,
+// and returns the new sub-collection. It is equivalent to PutCollection, with
+// optional progress reporting and concurrency. All the collections are made
+// before any data objects are put. If some data objects fail to be put, the
+// others are still put and an error describing the failures is returned.
+func (coll *Collection) PutDirectory(localPath string,
+	opts PutDirectoryOpts) (*Collection, error) {
+	localPath = filepath.Clean(localPath)
+
+	info, err := os.Stat(localPath)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	if !exists {
-		if _, err := MakeCollection(coll.client, coll.RodsPath()); err != nil {
+	if !info.IsDir() {
+		return nil, errors.Errorf("cannot put %s into %s because the former "+
+			"is not a directory", localPath, coll.RodsPath())
+	}
+
+	client := coll.client
+	objs, _, err := client.planPut(localPath, coll.RodsPath(), false)
+	if err != nil {
+		return nil, err
+	}
+
+	root := path.Join(coll.RodsPath(), filepath.Base(localPath))
+	colls := []string{root}
+	seen := map[string]bool{root: true}
+	for _, obj := range objs {
+		if !seen[obj.IPath] {
+			seen[obj.IPath] = true
+			colls = append(colls, obj.IPath)
+		}
+	}
+	for _, p := range colls {
+		if _, err = client.execute(MKDIR, Args{Recurse: true},
+			RodsItem{IPath: p}); err != nil {
+			return nil, err
+		}
+	}
+
+	var mu sync.Mutex
+	var done int
+	put := func(c *Client, obj RodsItem) error {
+		if _, perr := c.execute(PUT, Args{Force: true}, obj); perr != nil {
+			return perr
+		}
+		if opts.Progress != nil {
+			mu.Lock()
+			defer mu.Unlock()
+			done++
+			opts.Progress(obj, done, len(objs))
+		}
+		return nil
+	}
+
+	if opts.Pool != nil {
+		err = opts.Pool.applyToItems(objs, "put", put)
+	} else {
+		var bulk bulkErrors
+		for _, obj := range objs {
+			bulk.add(obj, put(client, obj))
+		}
+		err = bulk.err("put")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	item, err := client.ListItem(Args{}, RodsItem{IPath: root})
+	if err != nil {
+		return nil, err
+	}
+	item.client = client
+
+	return &Collection{&item}, nil
+}
+
+// Ensure creates the collection, and any leading collections, if they do not
+// exist. If any ACLs are supplied, they are added to each collection that is
+// created, but not to any that already existed. This allows new collections to
+// be given consistent access control, without changing that of existing ones.
+func (coll *Collection) Ensure(acls ...ACL) error {
+	// The collections to be created, deepest first
+	var missing []*Collection
+	for c := coll; ; c = c.Parent() {
+		exists, err := c.Exists()
+		if err != nil {
 			return err
 		}
+		if exists {
+			break
+		}
+		missing = append(missing, c)
+
+		// Only the deepest is required, unless ACLs are to be added
+		if len(acls) == 0 || c.RodsPath() == "/" {
+			break
+		}
+	}
+
+	if len(missing) == 0 {
+		return nil
+	}
+	if _, err := MakeCollection(coll.client, coll.RodsPath()); err != nil {
+		return err
+	}
+
+	if len(acls) > 0 {
+		for i := len(missing) - 1; i >= 0; i-- {
+			if err := missing[i].AddACLs(acls); err != nil {
+				return err
+			}
+		}
 	}
 
 	return nil
 }
 
+// WithClient associates the collection with a client and returns the
+// collection, as for RodsItem.WithClient.
+func (coll *Collection) WithClient(client *Client) *Collection {
+	coll.RodsItem.WithClient(client)
+	return coll
+}
+
 // Parent returns a new Collection that is the parent of this collection. If
 // the collection is the root level (i.e. the iRODS zone), the root level "/"
 // is returned.
@@ -155,6 +296,61 @@ func (coll *Collection) RemoveRecurse() error {
 	return err
 }
 
+// SetInheritance sets the ACL inheritance flag of the collection. When set,
+// new data objects and collections created within it inherit its ACLs.
+func (coll *Collection) SetInheritance(inherit bool) error {
+	level := ACLNoInherit
+	if inherit {
+		level = ACLInherit
+	}
+
+	it := CopyRodsItem(*coll.RodsItem)
+	it.IACLs = []ACL{{Level: level}}
+	if _, err := coll.client.Chmod(Args{}, it); err != nil {
+		return err
+	}
+	coll.inherit = &inherit
+
+	return nil
+}
+
+// InheritanceSet returns the ACL inheritance flag most recently set on this
+// Collection instance by SetInheritance, and true, or false and false if it has
+// not been set. This is only a local record; it is not the state of the
+// collection on the server, which baton-do does not report. It is therefore
+// not populated for collections that are listed or fetched, and it is stale if
+// inheritance has since been changed by other means.
+func (coll *Collection) InheritanceSet() (inherit bool, set bool) {
+	if coll.inherit == nil {
+		return false, false
+	}
+	return *coll.inherit, true
+}
+
+// Move moves (renames) the collection to remotePath and updates its path. Any
+// cached contents are updated to their new paths (this includes the instances
+// returned by Collections and DataObjects). Any other instances representing
+// items within the collection are stale after the move.
+func (coll *Collection) Move(remotePath string) error {
+	remotePath = filepath.Clean(remotePath)
+	oldPath := coll.RodsPath()
+
+	if _, err := coll.client.Move(Args{Path: remotePath}, *coll.RodsItem); err != nil {
+		return err
+	}
+	coll.IPath = remotePath
+
+	for i := range coll.IContents {
+		rel, err := filepath.Rel(oldPath, coll.IContents[i].IPath)
+		if err != nil {
+			return err
+		}
+		coll.IContents[i].IPath = filepath.Join(remotePath, rel)
+	}
+
+	return nil
+}
+
 // Collections returns the Collections from the collection contents. If the
 // contents have not been Fetched, the slice will be empty.
 func (coll *Collection) Collections() []Collection {
@@ -184,19 +380,87 @@ func (coll *Collection) DataObjects() []DataObject {
 }
 
 // Contents returns the collection contents. If the contents have not been
-// Fetched, the slice will be empty.
+// Fetched, the slice will be empty. The contents are those cached when last
+// fetched and are not re-fetched by this method; they may be stale. See
+// ContentsStale.
 func (coll *Collection) Contents() []RodsItem {
 	return coll.IContents
 }
 
+// ContentsStale returns true if the collection contents have been changed by
+// a mutating operation of this Collection (PutObject, RemoveObject or
+// RemoveObjectsWhere) since they were last fetched. Calling FetchContents,
+// FetchContentsDetailed, FetchContentsRecurse or Refresh makes them current.
+// Changes made by other means, including by other instances representing the
+// same collection, are not detected.
+func (coll *Collection) ContentsStale() bool {
+	return coll.stale
+}
+
+// PutObject puts a local file at localPath to a data object with the given
+// name in the collection, as PutDataObject does. The cached contents of the
+// collection are marked stale.
+func (coll *Collection) PutObject(localPath string, name string,
+	avus ...[]AVU) (*DataObject, error) {
+	coll.stale = true
+	return PutDataObject(coll.client, localPath,
+		path.Join(coll.RodsPath(), name), avus...)
+}
+
+// RemoveObject removes (deletes) the data object with the given name from the
+// collection. The cached contents of the collection are marked stale.
+func (coll *Collection) RemoveObject(name string) error {
+	coll.stale = true
+	return NewDataObject(coll.client, path.Join(coll.RodsPath(), name)).Remove()
+}
+
 // FetchContents returns a shallow list of the item contents, freshly
 // fetched from the server. It caches the slice for future calls to Contents.
 func (coll *Collection) FetchContents() ([]RodsItem, error) {
-	it, err := coll.client.ListItem(Args{Contents: true, Recurse: false}, *coll.RodsItem)
+	args := Args{Contents: true, Recurse: false}
+	it, err := coll.client.ListItem(args, *coll.RodsItem)
 	if err != nil {
 		return []RodsItem{}, err
 	}
 	coll.IContents = it.IContents
+	coll.recordFetch(args)
+
+	return coll.IContents, err
+}
+
+// FetchContentsDetailed returns a shallow list of the item contents, freshly
+// fetched from the server, as for FetchContents. The contents are populated
+// according to the supplied Args e.g. setting Args.AVU = true and
+// Args.ACL = true includes the AVUs and ACLs of each child, avoiding a
+// separate request for each. Args.Contents is always set and Args.Recurse is
+// not permitted. It caches the slice for future calls to Contents.
+//
+// Setting Args.Collection = true or Args.Object = true (but not both) restricts
+// the contents to collections or to data objects, respectively. baton-do does
+// not support this restriction when listing, so it is applied by the client.
+func (coll *Collection) FetchContentsDetailed(args Args) ([]RodsItem, error) {
+	args.Contents = true
+
+	onlyColls := args.Collection && !args.Object
+	onlyObjs := args.Object && !args.Collection
+	args.Collection, args.Object = false, false
+
+	it, err := coll.client.ListItem(args, *coll.RodsItem)
+	if err != nil {
+		return []RodsItem{}, err
+	}
+
+	contents := it.IContents
+	if onlyColls || onlyObjs {
+		contents = nil
+		for _, elt := range it.IContents {
+			if (onlyColls && elt.IsCollection()) || (onlyObjs && elt.IsDataObject()) {
+				contents = append(contents, elt)
+			}
+		}
+	}
+	coll.IContents = contents
+	coll.recordFetch(args)
 
 	return coll.IContents, err
 }
@@ -205,11 +469,144 @@ func (coll *Collection) FetchContents() ([]RodsItem, error) {
 // freshly fetched from the server. It caches the slice for future calls to
 // Contents.
 func (coll *Collection) FetchContentsRecurse() ([]RodsItem, error) {
-	items, err := coll.client.List(Args{Contents: true, Recurse: true}, *coll.RodsItem)
+	args := Args{Contents: true, Recurse: true}
+	items, err := coll.client.List(args, *coll.RodsItem)
 	if err != nil {
 		return []RodsItem{}, err
 	}
 	coll.IContents = items
+	coll.recordFetch(args)
 
 	return coll.IContents, err
 }
+
+// ModifiedTime returns the time the collection was last modified, for example
+// to allow a process to skip collections that have not changed since it last
+// ran. If baton-do does not report timestamps for the collection itself, the
+// time is derived from the latest modification of any data object it
+// contains directly. An error is returned if no time is available e.g. for an
+// empty collection. The cached contents are not changed.
+func (coll *Collection) ModifiedTime() (time.Time, error) {
+	args := Args{Contents: true, Timestamp: true}
+	it, err := coll.client.ListItem(args, *coll.RodsItem)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	modified := latestModified(it.ITimestamps)
+	if modified.IsZero() {
+		for _, elt := range it.IContents {
+			if latest := latestModified(elt.ITimestamps); latest.After(modified) {
+				modified = latest
+			}
+		}
+	}
+
+	if modified.IsZero() {
+		return time.Time{}, errors.Errorf("no modification time available "+
+			"for %s", coll.RodsPath())
+	}
+
+	return modified, nil
+}
+
+// Glob returns the collections and data objects within the collection,
+// recursively, whose names match the shell pattern, as for path.Match e.g.
+// "*.fast5". The pattern is matched against the last element of each path.
+// baton-do does not support patterns, so the collection is listed
+// recursively and the names are matched by the client.
+func (coll *Collection) Glob(pattern string) ([]RodsItem, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, errors.Wrapf(err, "invalid pattern '%s'", pattern)
+	}
+
+	items, err := coll.client.List(Args{Recurse: true}, *coll.RodsItem)
+	if err != nil {
+		return nil, err
+	}
+
+	var match []RodsItem
+	for _, item := range items {
+		if item.RodsPath() == coll.RodsPath() {
+			continue
+		}
+		if ok, _ := path.Match(pattern, path.Base(item.RodsPath())); ok {
+			match = append(match, item)
+		}
+	}
+
+	return match, err
+}
+
+// DistinctAttributes returns the sorted, distinct AVU attributes of the
+// collection and of every collection and data object within it, recursively,
+// freshly fetched from the server.
+func (coll *Collection) DistinctAttributes() ([]string, error) {
+	items, err := coll.client.List(Args{AVU: true, Recurse: true}, *coll.RodsItem)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]struct{})
+	var attrs []string
+	for _, item := range items {
+		for _, avu := range item.IAVUs {
+			if _, ok := seen[avu.Attr]; !ok {
+				seen[avu.Attr] = struct{}{}
+				attrs = append(attrs, avu.Attr)
+			}
+		}
+	}
+	sort.Strings(attrs)
+
+	return attrs, err
+}
+
+// RemoveObjectsWhere removes (deletes) every data object within the
+// collection, recursively, for which the predicate returns true. The data
+// objects are passed to the predicate with their metadata fetched. Each removal
+// is logged. Failure to remove a data object does not prevent attempts to
+// remove the remainder; if any fail, the first error is returned, annotated
+// with the number of failures.
+// The cached contents of the collection are marked stale if any data objects
+// match.
+func (coll *Collection) RemoveObjectsWhere(pred func(obj DataObject) bool) error {
+	items, err := coll.client.List(Args{AVU: true, Recurse: true}, *coll.RodsItem)
+	if err != nil {
+		return err
+	}
+
+	log := logs.GetLogger()
+
+	var firstErr error
+	var numMatched, numFailed int
+	for i := range items {
+		if !items[i].IsDataObject() {
+			continue
+		}
+
+		obj := DataObject{&items[i]}
+		if !pred(obj) {
+			continue
+		}
+		numMatched++
+		coll.stale = true
+
+		log.Info().Str("path", obj.RodsPath()).Msg("removing data object")
+		if rerr := obj.Remove(); rerr != nil {
+			log.Error().Err(rerr).Str("path", obj.RodsPath()).
+				Msg("failed to remove data object")
+			if firstErr == nil {
+				firstErr = rerr
+			}
+			numFailed++
+		}
+	}
+
+	if firstErr != nil {
+		return errors.Wrapf(firstErr, "failed to remove %d of %d matching "+
+			"data objects in '%s'", numFailed, numMatched, coll.RodsPath())
+	}
+
+	return nil
+}
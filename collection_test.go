@@ -23,6 +23,7 @@ package extendo_test
 
 import (
 	"path/filepath"
+	"time"
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
@@ -206,6 +207,90 @@ var _ = Describe("Put a Collection into iRODS", func() {
 			Expect(err).ToNot(HaveOccurred())
 			Expect(coll.RodsPath()).To(Equal(remotePath))
 		})
+
+		It("should have a recent modification time", func() {
+			localPath := "testdata"
+			remotePath := filepath.Join(workColl, "testdata")
+
+			_, err := ex.PutCollection(client, localPath, remotePath)
+			Expect(err).ToNot(HaveOccurred())
+
+			coll := ex.NewCollection(client,
+				filepath.Join(remotePath, "1/reads/fast5"))
+			modified, err := coll.ModifiedTime()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(time.Since(modified)).To(BeNumerically("<", time.Minute))
+		})
+	})
+})
+
+var _ = Describe("Put a directory into a Collection", func() {
+	var (
+		client *ex.Client
+		pool   *ex.ClientPool
+		err    error
+
+		rootColl, workColl string
+
+		getRodsPaths itemPathTransform
+	)
+
+	BeforeEach(func() {
+		client, err = ex.FindAndStart(batonArgs...)
+		Expect(err).NotTo(HaveOccurred())
+
+		pool = ex.NewClientPool(ex.DefaultClientPoolParams, batonArgs...)
+
+		rootColl = "/testZone/home/irods"
+		workColl = tmpRodsPath(rootColl, "ExtendoPutDirectory")
+
+		getRodsPaths = makeRodsItemTransform(workColl)
+	})
+
+	AfterEach(func() {
+		err = removeTmpCollection(workColl)
+		Expect(err).NotTo(HaveOccurred())
+
+		pool.Close()
+		client.StopIgnoreError()
+	})
+
+	When("a directory is put into a collection concurrently", func() {
+		It("should be present afterwards, with progress reported", func() {
+			coll, err := ex.MakeCollection(client, workColl)
+			Expect(err).ToNot(HaveOccurred())
+
+			var numDone, numTotal int
+			var progress []string
+			opts := ex.PutDirectoryOpts{
+				Pool: pool,
+				Progress: func(obj ex.RodsItem, done int, total int) {
+					numDone, numTotal = done, total
+					progress = append(progress, obj.RodsPath())
+				},
+			}
+
+			put, err := coll.PutDirectory("testdata", opts)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(put.RodsPath()).To(Equal(filepath.Join(workColl, "testdata")))
+
+			objs, err := put.FetchContentsRecurse()
+			Expect(err).ToNot(HaveOccurred())
+
+			var expected []string
+			for _, item := range objs {
+				if item.IsDataObject() {
+					expected = append(expected, item.RodsPath())
+				}
+			}
+			Expect(expected).To(HaveLen(9))
+			Expect(progress).To(ConsistOf(expected))
+			Expect(numDone).To(Equal(9))
+			Expect(numTotal).To(Equal(9))
+
+			Expect(getRodsPaths(objs)).To(ContainElement(
+				"testdata/1/reads/fast5/reads1.fast5"))
+		})
 	})
 })
 
@@ -286,6 +371,36 @@ var _ = Describe("Ensure that a Collection exists", func() {
 		})
 	})
 
+	When("a branch collection does not exist and ACLs are supplied", func() {
+		var (
+			existing   *ex.Collection
+			publicRead = ex.ACL{Owner: "public", Level: "read", Zone: "testZone"}
+		)
+
+		BeforeEach(func() {
+			existing, err = ex.MakeCollection(client,
+				filepath.Join(workColl, "my_new_collection"))
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("should add the ACLs to only the collections created", func() {
+			path := filepath.Join(existing.RodsPath(), "and_another/and_finally")
+			coll := ex.NewCollection(client, path)
+			err = coll.Ensure(publicRead)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(coll.Exists()).To(BeTrue())
+
+			for _, c := range []*ex.Collection{coll, coll.Parent()} {
+				acls, err := c.FetchACLs()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(acls).To(ContainElement(publicRead))
+			}
+
+			acls, err := existing.FetchACLs()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(acls).NotTo(ContainElement(publicRead))
+		})
+	})
 })
 
 var _ = Describe("List a Collection contents", func() {
@@ -342,6 +457,66 @@ var _ = Describe("List a Collection contents", func() {
 		})
 	})
 
+	When("a collection contents are fetched with details", func() {
+		var avu = ex.AVU{Attr: "test_attr_detail", Value: "1"}
+
+		BeforeEach(func() {
+			for _, name := range []string{"1", "testdir"} {
+				child := ex.NewCollection(client,
+					filepath.Join(workColl, "testdata", name))
+				err = child.AddMetadata([]ex.AVU{avu})
+				Expect(err).NotTo(HaveOccurred())
+			}
+		})
+
+		It("should return the shallow contents with AVUs", func() {
+			coll := ex.NewCollection(client, filepath.Join(workColl, "testdata"))
+			items, err := coll.FetchContentsDetailed(ex.Args{AVU: true, ACL: true})
+			Expect(err).NotTo(HaveOccurred())
+
+			expected := []string{"testdata/1", "testdata/testdir"}
+			Expect(items).To(WithTransform(getRodsPaths, ConsistOf(expected)))
+
+			for _, item := range items {
+				Expect(item.IAVUs).To(ContainElement(avu))
+				Expect(item.IACLs).NotTo(BeEmpty())
+			}
+		})
+
+		It("should not permit recursion", func() {
+			coll := ex.NewCollection(client, filepath.Join(workColl, "testdata"))
+			_, err := coll.FetchContentsDetailed(ex.Args{Recurse: true})
+			Expect(err).To(MatchError("invalid argument: Recurse=true"))
+		})
+	})
+
+	When("a collection contents are fetched by type", func() {
+		var coll *ex.Collection
+
+		BeforeEach(func() {
+			coll = ex.NewCollection(client, filepath.Join(workColl, "testdata/1"))
+			_, err = ex.PutDataObject(client, "testdata/1/reads/fast5/reads1.fast5",
+				filepath.Join(coll.RodsPath(), "reads1.fast5"))
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("should return only the data objects", func() {
+			items, err := coll.FetchContentsDetailed(ex.Args{Object: true})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(items).To(WithTransform(getRodsPaths,
+				ConsistOf("testdata/1/reads1.fast5")))
+			Expect(coll.Collections()).To(BeEmpty())
+		})
+
+		It("should return only the collections", func() {
+			items, err := coll.FetchContentsDetailed(ex.Args{Collection: true})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(items).To(WithTransform(getRodsPaths,
+				ConsistOf("testdata/1/reads")))
+			Expect(coll.DataObjects()).To(BeEmpty())
+		})
+	})
+
 	When("a collection contents are fetched with recursion", func() {
 		It("should return the deep contents", func() {
 			coll := ex.NewCollection(client, filepath.Join(workColl, "testdata"))
@@ -395,3 +570,332 @@ var _ = Describe("List a Collection contents", func() {
 		})
 	})
 })
+
+var _ = Describe("Find items in a Collection by pattern", func() {
+	var (
+		client *ex.Client
+		err    error
+
+		rootColl, workColl string
+
+		getRodsPaths itemPathTransform
+	)
+
+	BeforeEach(func() {
+		client, err = ex.FindAndStart(batonArgs...)
+		Expect(err).NotTo(HaveOccurred())
+
+		rootColl = "/testZone/home/irods"
+		workColl = tmpRodsPath(rootColl, "ExtendoGlob")
+
+		getRodsPaths = makeRodsItemTransform(workColl)
+
+		err = putTestData("testdata/", workColl)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		err = removeTmpCollection(workColl)
+		Expect(err).NotTo(HaveOccurred())
+
+		client.StopIgnoreError()
+	})
+
+	When("items match the pattern", func() {
+		It("should return only those items", func() {
+			coll := ex.NewCollection(client, filepath.Join(workColl, "testdata"))
+			items, err := coll.Glob("*.fast5")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(items).To(WithTransform(getRodsPaths, ConsistOf(
+				"testdata/1/reads/fast5/reads1.fast5",
+				"testdata/1/reads/fast5/reads2.fast5",
+				"testdata/1/reads/fast5/reads3.fast5")))
+		})
+	})
+
+	When("the pattern is invalid", func() {
+		It("should return an error", func() {
+			coll := ex.NewCollection(client, filepath.Join(workColl, "testdata"))
+			_, err := coll.Glob("[")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
+
+var _ = Describe("Find the distinct metadata attributes in a Collection", func() {
+	var (
+		client *ex.Client
+		err    error
+
+		rootColl, workColl string
+	)
+
+	BeforeEach(func() {
+		client, err = ex.FindAndStart(batonArgs...)
+		Expect(err).NotTo(HaveOccurred())
+
+		rootColl = "/testZone/home/irods"
+		workColl = tmpRodsPath(rootColl, "ExtendoDistinctAttributes")
+
+		err = putTestData("testdata/", workColl)
+		Expect(err).NotTo(HaveOccurred())
+
+		tags := map[string][]ex.AVU{
+			"testdata/1/reads/fast5/reads1.fast5": {
+				{Attr: "test_attr_b", Value: "1"},
+				{Attr: "test_attr_a", Value: "1"}},
+			"testdata/1/reads/fastq/reads1.fastq": {
+				{Attr: "test_attr_a", Value: "2"},
+				{Attr: "test_attr_c", Value: "1"}},
+		}
+		for path, avus := range tags {
+			obj := ex.NewDataObject(client, filepath.Join(workColl, path))
+			err = obj.AddMetadata(avus)
+			Expect(err).NotTo(HaveOccurred())
+		}
+
+		coll := ex.NewCollection(client, filepath.Join(workColl, "testdata/1"))
+		err = coll.AddMetadata([]ex.AVU{{Attr: "test_attr_d", Value: "1"}})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		err = removeTmpCollection(workColl)
+		Expect(err).NotTo(HaveOccurred())
+
+		client.StopIgnoreError()
+	})
+
+	When("items in the collection have metadata", func() {
+		It("should return the sorted distinct attributes", func() {
+			coll := ex.NewCollection(client, filepath.Join(workColl, "testdata"))
+			attrs, err := coll.DistinctAttributes()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(attrs).To(Equal([]string{"test_attr_a", "test_attr_b",
+				"test_attr_c", "test_attr_d"}))
+		})
+	})
+})
+
+var _ = Describe("Remove data objects from a Collection by predicate", func() {
+	var (
+		client *ex.Client
+		err    error
+
+		rootColl, workColl string
+
+		getRodsPaths itemPathTransform
+
+		obsolete = ex.AVU{Attr: "test_attr_obsolete", Value: "1"}
+	)
+
+	BeforeEach(func() {
+		client, err = ex.FindAndStart(batonArgs...)
+		Expect(err).NotTo(HaveOccurred())
+
+		rootColl = "/testZone/home/irods"
+		workColl = tmpRodsPath(rootColl, "ExtendoRemoveWhere")
+
+		getRodsPaths = makeRodsItemTransform(workColl)
+
+		err = putTestData("testdata/", workColl)
+		Expect(err).NotTo(HaveOccurred())
+
+		for _, name := range []string{"reads1.fast5", "reads2.fast5"} {
+			obj := ex.NewDataObject(client,
+				filepath.Join(workColl, "testdata/1/reads/fast5", name))
+			err = obj.AddMetadata([]ex.AVU{obsolete})
+			Expect(err).NotTo(HaveOccurred())
+		}
+	})
+
+	AfterEach(func() {
+		err = removeTmpCollection(workColl)
+		Expect(err).NotTo(HaveOccurred())
+
+		client.StopIgnoreError()
+	})
+
+	When("data objects match a metadata predicate", func() {
+		It("should remove only those data objects", func() {
+			coll := ex.NewCollection(client, filepath.Join(workColl, "testdata"))
+			err := coll.RemoveObjectsWhere(func(obj ex.DataObject) bool {
+				return obj.HasMetadatum(obsolete)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			items, err := coll.FetchContentsRecurse()
+			Expect(err).NotTo(HaveOccurred())
+
+			var objs []ex.RodsItem
+			for _, item := range items {
+				if item.IsDataObject() {
+					objs = append(objs, item)
+				}
+			}
+
+			expected := []string{
+				"testdata/1/reads/fast5/reads1.fast5.md5",
+				"testdata/1/reads/fast5/reads3.fast5",
+				"testdata/1/reads/fastq/reads1.fastq",
+				"testdata/1/reads/fastq/reads1.fastq.md5",
+				"testdata/1/reads/fastq/reads2.fastq",
+				"testdata/1/reads/fastq/reads3.fastq",
+				"testdata/testdir/.gitignore",
+			}
+			Expect(objs).To(WithTransform(getRodsPaths, ConsistOf(expected)))
+		})
+	})
+})
+
+var _ = Describe("Set ACL inheritance on a Collection", func() {
+	var (
+		client *ex.Client
+		err    error
+
+		rootColl, workColl string
+		coll               *ex.Collection
+
+		publicRead = ex.ACL{Owner: "public", Level: "read", Zone: "testZone"}
+	)
+
+	BeforeEach(func() {
+		client, err = ex.FindAndStart(batonArgs...)
+		Expect(err).NotTo(HaveOccurred())
+
+		rootColl = "/testZone/home/irods"
+		workColl = tmpRodsPath(rootColl, "ExtendoInheritance")
+
+		coll, err = ex.MakeCollection(client, workColl)
+		Expect(err).NotTo(HaveOccurred())
+
+		err = coll.AddACLs([]ex.ACL{publicRead})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		err = removeTmpCollection(workColl)
+		Expect(err).NotTo(HaveOccurred())
+
+		client.StopIgnoreError()
+	})
+
+	When("inheritance has not been set", func() {
+		It("should not be recorded", func() {
+			_, set := coll.InheritanceSet()
+			Expect(set).To(BeFalse())
+		})
+	})
+
+	When("inheritance is set", func() {
+		BeforeEach(func() {
+			err = coll.SetInheritance(true)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("should be recorded", func() {
+			inherit, set := coll.InheritanceSet()
+			Expect(set).To(BeTrue())
+			Expect(inherit).To(BeTrue())
+		})
+
+		It("should cause new data objects to inherit ACLs", func() {
+			obj, err := ex.PutDataObject(client,
+				"testdata/1/reads/fast5/reads1.fast5",
+				filepath.Join(workColl, "reads1.fast5"))
+			Expect(err).NotTo(HaveOccurred())
+
+			acls, err := obj.FetchACLs()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(acls).To(ContainElement(publicRead))
+		})
+
+		When("inheritance is then unset", func() {
+			BeforeEach(func() {
+				err = coll.SetInheritance(false)
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			It("should be recorded", func() {
+				inherit, set := coll.InheritanceSet()
+				Expect(set).To(BeTrue())
+				Expect(inherit).To(BeFalse())
+			})
+
+			It("should not cause new data objects to inherit ACLs", func() {
+				obj, err := ex.PutDataObject(client,
+					"testdata/1/reads/fast5/reads1.fast5",
+					filepath.Join(workColl, "reads1.fast5"))
+				Expect(err).NotTo(HaveOccurred())
+
+				acls, err := obj.FetchACLs()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(acls).NotTo(ContainElement(publicRead))
+			})
+		})
+	})
+})
+
+var _ = Describe("Move a Collection in iRODS", func() {
+	var (
+		client *ex.Client
+		err    error
+
+		rootColl, workColl string
+
+		getCollPaths collPathTransform
+	)
+
+	BeforeEach(func() {
+		client, err = ex.FindAndStart(batonArgs...)
+		Expect(err).NotTo(HaveOccurred())
+
+		rootColl = "/testZone/home/irods"
+		workColl = tmpRodsPath(rootColl, "ExtendoMoveCollection")
+
+		getCollPaths = makeCollTransform(workColl)
+
+		err = putTestData("testdata/", workColl)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		err = removeTmpCollection(workColl)
+		Expect(err).NotTo(HaveOccurred())
+
+		client.StopIgnoreError()
+	})
+
+	When("a collection is moved", func() {
+		var coll *ex.Collection
+		var oldPath, newPath string
+
+		BeforeEach(func() {
+			oldPath = filepath.Join(workColl, "testdata")
+			newPath = filepath.Join(workColl, "moved")
+
+			coll = ex.NewCollection(client, oldPath)
+			_, err = coll.FetchContents()
+			Expect(err).NotTo(HaveOccurred())
+
+			err = coll.Move(newPath)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("should report the new path", func() {
+			Expect(coll.RodsPath()).To(Equal(newPath))
+			Expect(coll.Exists()).To(BeTrue())
+			Expect(ex.NewCollection(client, oldPath).Exists()).To(BeFalse())
+		})
+
+		It("should update its cached contents", func() {
+			expected := []string{"moved/1", "moved/testdir"}
+			Expect(coll.Collections()).To(WithTransform(getCollPaths,
+				ConsistOf(expected)))
+
+			for _, c := range coll.Collections() {
+				Expect(c.Exists()).To(BeTrue())
+			}
+		})
+	})
+})
@@ -21,11 +21,31 @@
 package extendo
 
 import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/pkg/errors"
+	logs "github.com/wtsi-npg/logshim"
 )
 
+// DataObject represents a data object in iRODS. Like the RodsItem that it
+// embeds, a DataObject is not safe for concurrent use in general. However,
+// the methods that return cached detail (ACLs, Metadata, HasMetadatum,
+// HasSomeMetadata, HasAllMetadata, Checksum, Replicates, ValidReplicates,
+// InvalidReplicates, Timestamps, Size, RodsPath and String) do not modify the
+// data object, so may be called concurrently, provided that no goroutine calls
+// a method that does.
+//
+// The methods that modify a data object are the Fetch methods,
+// CalculateChecksum, Refresh, Sync, the methods that change ACLs or metadata
+// and WithClient. To share a data object between goroutines that need to fetch
+// detail, give each its own copy, made with CopyRodsItem.
 type DataObject struct {
 	*RodsItem
 }
@@ -84,6 +104,44 @@ func PutDataObject(client *Client, localPath string, remotePath string,
 	return obj, err
 }
 
+// PutDataObjectIfNewer puts a local file to a data object, as PutDataObject
+// does, unless the data object already exists and was modified more recently
+// than the local file. This avoids overwriting newer data on the server. The
+// boolean return value is true if the file was put. If it was not, the
+// returned instance is the existing data object, with its checksum, metadata
+// and timestamps fetched to the client.
+func PutDataObjectIfNewer(client *Client, localPath string, remotePath string,
+	avus ...[]AVU) (*DataObject, bool, error) {
+	info, err := os.Stat(localPath)
+	if err != nil {
+		return nil, false, err
+	}
+
+	remote := NewDataObject(client, remotePath)
+	item, err := client.ListItem(Args{Checksum: true, AVU: true, Timestamp: true},
+		*remote.RodsItem)
+	if err != nil {
+		code, cerr := RodsErrorCode(err)
+		if cerr != nil || code != RodsUserFileDoesNotExist {
+			return nil, false, err
+		}
+	} else if modified := latestModified(item.ITimestamps); modified.After(info.ModTime()) {
+		logs.GetLogger().Debug().Str("path", item.RodsPath()).
+			Time("remote_modified", modified).
+			Time("local_modified", info.ModTime()).
+			Msg("skipping put, the data object is newer than the local file")
+
+		return &DataObject{&item}, false, nil
+	}
+
+	obj, err := PutDataObject(client, localPath, remotePath, avus...)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return obj, true, err
+}
+
 // ArchiveDataObject copies a file to a data object. The intended use case is
 // for when setting a canonical form for the data for long term storage,
 // superseding any file and metadata already there.
@@ -93,7 +151,9 @@ func PutDataObject(client *Client, localPath string, remotePath string,
 // do not match.
 //
 // It also differs from PutDataObject in that it uses ReplaceMetadata to
-// set metadata, rather than AddMetadata.
+// set metadata, rather than AddMetadata. The metadata listed after the put
+// are used as the current metadata to be replaced, saving a round trip to the
+// server.
 func ArchiveDataObject(client *Client, localPath string, remotePath string,
 	expectedChecksum string, avus ...[]AVU) (*DataObject, error) {
 
@@ -109,14 +169,196 @@ func ArchiveDataObject(client *Client, localPath string, remotePath string,
 				localPath, remotePath, expectedChecksum, obj.Checksum())
 	}
 
+	err = obj.replaceMetadata(obj.IAVUs, joinAVUs(avus))
+
+	return obj, err
+}
+
+// PutReplaceDataObject copies a file to a data object and sets its metadata,
+// as ArchiveDataObject does, using ReplaceMetadata semantics. Unlike
+// ArchiveDataObject, it requires no expected checksum; the checksum calculated
+// by the server is trusted. The returned instance has the new checksum.
+func PutReplaceDataObject(client *Client, localPath string, remotePath string,
+	avus ...[]AVU) (*DataObject, error) {
+
+	obj, err := PutDataObject(client, localPath, remotePath)
+	if err != nil {
+		return nil, err
+	}
+
+	err = obj.replaceMetadata(obj.IAVUs, joinAVUs(avus))
+
+	return obj, err
+}
+
+// PutDataObjectWithACLs puts a local file to a data object and adds metadata,
+// as PutDataObject does, and then sets its ACLs explicitly, so that its access
+// does not depend on whether the collection's ACLs are inherited. Any ACL of
+// the new data object for an owner not in acls is removed, unless it is at the
+// own level (such as that of the creating user), after which the argument
+// ACLs are added. The returned instance has its ACLs fetched.
+func PutDataObjectWithACLs(client *Client, localPath string, remotePath string,
+	acls []ACL, avus ...[]AVU) (*DataObject, error) {
+
+	obj, err := PutDataObject(client, localPath, remotePath, avus...)
+	if err != nil {
+		return nil, err
+	}
+
+	current, err := obj.FetchACLs()
+	if err != nil {
+		return nil, err
+	}
+
+	requested := func(acl ACL) bool {
+		for _, a := range acls {
+			if a.Owner == acl.Owner && (a.Zone == "" || a.Zone == acl.Zone) {
+				return true
+			}
+		}
+		return false
+	}
+
+	var set []ACL
+	for _, acl := range current {
+		if acl.Level != ACLOwn && !requested(acl) {
+			set = append(set, ACL{Owner: acl.Owner, Level: ACLNull, Zone: acl.Zone})
+		}
+	}
+	set = append(set, acls...)
+
+	if len(set) > 0 {
+		err = obj.AddACLs(set)
+	}
+
+	return obj, err
+}
+
+// PutVerified puts a local file to a data object, as PutDataObject does, and
+// compares the checksum calculated by the server with the MD5 checksum of the
+// local file. If iRODS reports a checksum mismatch during the put, or the
+// checksums do not match afterwards, the put is retried, making up to maxTries
+// attempts in all, before an error is returned. If the server checksum is not
+// MD5 (e.g. the zone uses SHA-256), it cannot be compared and an error is
+// returned at once. If any slices of AVUs are supplied, they are added once
+// the checksums match. This is intended for transfers over unreliable
+// networks.
+func PutVerified(client *Client, localPath string, remotePath string,
+	maxTries int, avus ...[]AVU) (*DataObject, error) {
+	put := func() (*DataObject, error) {
+		return PutDataObject(client, localPath, remotePath)
+	}
+
+	obj, err := putVerified(put, localPath, remotePath, maxTries)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(avus) > 0 {
+		err = obj.AddMetadata(joinAVUs(avus))
+	}
+
+	return obj, err
+}
+
+// putVerified calls put until the checksum of the data object it returns
+// matches the MD5 checksum of the local file at localPath, making up to
+// maxTries attempts. A put failing with an iRODS checksum mismatch is retried;
+// any other failure is returned at once.
+func putVerified(put func() (*DataObject, error), localPath string,
+	remotePath string, maxTries int) (*DataObject, error) {
+	if maxTries < 1 {
+		return nil, errors.Errorf("invalid maxTries %d", maxTries)
+	}
+
+	expected, err := md5File(localPath)
+	if err != nil {
+		return nil, err
+	}
+
+	log := logs.GetLogger()
+
+	var obj *DataObject
+	for try := 1; try <= maxTries; try++ {
+		obj, err = put()
+		if err != nil {
+			code, cerr := RodsErrorCode(err)
+			if cerr != nil || code != RodsUserChecksumMismatch {
+				return nil, err
+			}
+
+			log.Warn().Err(err).Str("local_path", localPath).
+				Str("remote_path", remotePath).
+				Int("try", try).Int("max_tries", maxTries).
+				Msg("checksum mismatch reported by put")
+			continue
+		}
+
+		observed := obj.Checksum()
+		if !isMD5Checksum(observed) {
+			return nil, errors.Errorf("failed to verify the put of '%s' to "+
+				"'%s': remote checksum '%s' is not an MD5 checksum",
+				localPath, remotePath, observed)
+		}
+		if observed == expected {
+			return obj, nil
+		}
+
+		err = errors.Errorf("local checksum '%s' did not match remote "+
+			"checksum '%s'", expected, observed)
+		log.Warn().Str("local_path", localPath).
+			Str("remote_path", remotePath).
+			Str("expected", expected).Str("observed", observed).
+			Int("try", try).Int("max_tries", maxTries).
+			Msg("checksum mismatch after put")
+	}
+
+	return nil, errors.Wrapf(err, "failed to put '%s' to '%s' after %d tries",
+		localPath, remotePath, maxTries)
+}
+
+// isMD5Checksum returns true if checksum is a hex-encoded MD5 checksum, as
+// opposed to e.g. an iRODS SHA-256 checksum, which has the prefix "sha2:".
+func isMD5Checksum(checksum string) bool {
+	if len(checksum) != hex.EncodedLen(md5.Size) {
+		return false
+	}
+	_, err := hex.DecodeString(checksum)
+
+	return err == nil
+}
+
+// md5File returns the hex-encoded MD5 checksum of the local file at localPath.
+func md5File(localPath string) (string, error) {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := md5.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", errors.Wrapf(err, "failed to read '%s'", localPath)
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), err
+}
+
+// joinAVUs returns the unique AVUs of the slices of AVUs.
+func joinAVUs(avus [][]AVU) []AVU {
 	var allAVUs []AVU
 	for _, x := range avus {
 		allAVUs = append(allAVUs, x...)
 	}
 
-	err = obj.ReplaceMetadata(UniqAVUs(allAVUs))
+	return UniqAVUs(allAVUs)
+}
 
-	return obj, err
+// WithClient associates the data object with a client and returns the data
+// object, as for RodsItem.WithClient.
+func (obj *DataObject) WithClient(client *Client) *DataObject {
+	obj.RodsItem.WithClient(client)
+	return obj
 }
 
 // Parent returns a new Collection that is containing this data object.
@@ -124,19 +366,54 @@ func (obj *DataObject) Parent() *Collection {
 	return NewCollection(obj.client, obj.IPath)
 }
 
-// Remove removes (deletes) the data object.
+// Remove removes (deletes) the data object. It is equivalent to Trash.
 func (obj *DataObject) Remove() error {
-	_, err := obj.client.RemObj(Args{}, *obj.RodsItem)
+	return obj.Delete(false)
+}
+
+// Trash removes the data object to the iRODS trash, if the zone has trash
+// enabled, from where it may be recovered.
+func (obj *DataObject) Trash() error {
+	return obj.Delete(false)
+}
+
+// Delete removes the data object. If force is true, the iRODS trash is
+// bypassed and the data object is removed permanently. Otherwise, it is
+// removed to the trash, as for Trash.
+func (obj *DataObject) Delete(force bool) error {
+	_, err := obj.client.RemObj(Args{Force: force}, *obj.RodsItem)
 	return err
 }
 
-// Checksum returns the locally cached checksum of the data object.
+// Checksum returns the locally cached checksum of the data object. This is
+// the empty string if the checksum has not been fetched, or if the data object
+// has no checksum; use FetchChecksum or ChecksumOrFetch to fetch it.
 func (obj *DataObject) Checksum() string {
 	return obj.IChecksum
 }
 
-// CalculateChecksum causes the remote checksum to be recalculated and updates
-// its local cache, returning the new checksum.
+// ChecksumOrFetch returns the locally cached checksum of the data object. If
+// this is empty, it fetches the checksum recorded in iRODS, as FetchChecksum.
+// A data object with no checksum is therefore fetched on each call.
+func (obj *DataObject) ChecksumOrFetch() (string, error) {
+	if obj.IChecksum != "" {
+		return obj.IChecksum, nil
+	}
+
+	return obj.FetchChecksum()
+}
+
+// Size returns the locally cached size of the data object, in bytes. If the
+// size has not been fetched (e.g. by listing with Args.Size or calling Sync),
+// it is zero.
+func (obj *DataObject) Size() uint64 {
+	return obj.ISize
+}
+
+// CalculateChecksum causes the remote checksum to be recalculated from the
+// data by iRODS and updates its local cache, returning the new checksum. This
+// reads all the data and is expensive for large data objects; to read the
+// checksum already recorded, use FetchChecksum.
 func (obj *DataObject) CalculateChecksum() (string, error) {
 	item, err := obj.client.Checksum(Args{Checksum: true, Force: true}, *obj.RodsItem)
 	if err != nil {
@@ -147,13 +424,16 @@ func (obj *DataObject) CalculateChecksum() (string, error) {
 	return obj.IChecksum, err
 }
 
-// FetchChecksum fetches the remote checksum, caches it locally and returns it.
+// FetchChecksum fetches the checksum recorded in iRODS, caches it locally and
+// returns it. This is cheap because the checksum is not recalculated; to do
+// that, use CalculateChecksum.
 func (obj *DataObject) FetchChecksum() (string, error) {
 	checksum, err := obj.client.ListChecksum(*obj.RodsItem)
 	if err != nil {
 		return "", err
 	}
 	obj.IChecksum = checksum
+	obj.recordFetch(Args{Checksum: true})
 
 	return obj.IChecksum, err
 }
@@ -203,15 +483,56 @@ func (obj *DataObject) Replicates() []Replicate {
 }
 
 func (obj *DataObject) FetchReplicates() ([]Replicate, error) {
-	item, err := obj.client.ListItem(Args{Replicate: true}, *obj.RodsItem)
+	args := Args{Replicate: true}
+	item, err := obj.client.ListItem(args, *obj.RodsItem)
 	if err != nil {
 		return []Replicate{}, err
 	}
 	obj.IReplicates = item.IReplicates
+	obj.recordFetch(args)
 
 	return obj.IReplicates, err
 }
 
+// ReplicaChecksumsAgree fetches the replicates of the data object, with their
+// checksums, and returns true if all the valid replicates have the same
+// checksum. Divergent checksums indicate that at least one replicate is
+// corrupt. A valid replicate without a checksum cannot be shown to agree, so it
+// is treated as a disagreement. Invalid (stale) replicates are not compared.
+func (obj *DataObject) ReplicaChecksumsAgree() (bool, error) {
+	args := Args{Checksum: true, Replicate: true}
+	item, err := obj.client.ListItem(args, *obj.RodsItem)
+	if err != nil {
+		return false, err
+	}
+	obj.IChecksum = item.IChecksum
+	obj.IReplicates = item.IReplicates
+	obj.recordFetch(args)
+
+	return replicateChecksumsAgree(obj.IReplicates), nil
+}
+
+func replicateChecksumsAgree(reps []Replicate) bool {
+	var checksum string
+	for _, r := range reps {
+		if !r.Valid {
+			continue
+		}
+		if r.Checksum == "" {
+			return false
+		}
+		if checksum == "" {
+			checksum = r.Checksum
+			continue
+		}
+		if r.Checksum != checksum {
+			return false
+		}
+	}
+
+	return true
+}
+
 func (obj *DataObject) ValidReplicates() []Replicate {
 	return obj.filterReplicates(func(r Replicate) bool {
 		return r.Valid
@@ -224,6 +545,184 @@ func (obj *DataObject) InvalidReplicates() []Replicate {
 	})
 }
 
+// latestModified returns the latest modification time of the timestamps, or
+// the zero time if there are none.
+func latestModified(timestamps []Timestamp) time.Time {
+	var latest time.Time
+	for _, ts := range timestamps {
+		if ts.Modified.After(latest) {
+			latest = ts.Modified
+		}
+	}
+
+	return latest
+}
+
+// Timestamps returns the locally cached timestamps of the data object.
+func (obj *DataObject) Timestamps() []Timestamp {
+	return obj.ITimestamps
+}
+
+// FetchTimestamps fetches the remote timestamps, caches them locally and
+// returns them.
+func (obj *DataObject) FetchTimestamps() ([]Timestamp, error) {
+	args := Args{Timestamp: true}
+	item, err := obj.client.ListItem(args, *obj.RodsItem)
+	if err != nil {
+		return []Timestamp{}, err
+	}
+	obj.ITimestamps = item.ITimestamps
+	obj.recordFetch(args)
+
+	return obj.ITimestamps, err
+}
+
+// Age fetches the timestamps of the data object and returns the time elapsed
+// since the latest modification of any of its replicates.
+func (obj *DataObject) Age() (time.Duration, error) {
+	timestamps, err := obj.FetchTimestamps()
+	if err != nil {
+		return 0, err
+	}
+
+	modified := latestModified(timestamps)
+	if modified.IsZero() {
+		return 0, errors.Errorf("no modification time available for %s",
+			obj.RodsPath())
+	}
+
+	return time.Since(modified), err
+}
+
+// IsOlderThan returns true if the data object was last modified more than d
+// ago.
+func (obj *DataObject) IsOlderThan(d time.Duration) (bool, error) {
+	age, err := obj.Age()
+	if err != nil {
+		return false, err
+	}
+
+	return age > d, err
+}
+
+// LockAttr is the attribute of the AVU used by Lock to mark a data object as
+// locked.
+const LockAttr = "extendo:lock"
+
+var errLocked = errors.New("data object locked")
+
+// IsLocked returns true if the Cause of the error is that a data object was
+// locked by another holder when Lock was called.
+func IsLocked(err error) bool {
+	return errors.Cause(err) == errLocked
+}
+
+// lockHolder identifies this process as the holder of a lock.
+var lockHolder = func() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return fmt.Sprintf("%s:%d", host, os.Getpid())
+}()
+
+// Lock marks the data object as locked by this process for the duration ttl,
+// by adding a lock AVU (see LockAttr) recording the holder and the expiry
+// time. If the data object already has an unexpired lock, including one held
+// by this process, an error is returned for which IsLocked is true. Expired
+// locks are removed.
+//
+// The lock is advisory and cooperative; it does not prevent any changes to the
+// data object, but allows writers that use it to avoid e.g. ingesting the same
+// data twice. iRODS has no transactions for metadata, so a very short window
+// remains in which two writers may both take the lock; where this is
+// detected, both fail.
+func (obj *DataObject) Lock(ttl time.Duration) error {
+	now := time.Now()
+	current, expired, err := obj.locks(now)
+	if err != nil {
+		return err
+	}
+	if len(current) > 0 {
+		return errors.Wrapf(errLocked, "'%s' is locked: %s", obj.RodsPath(),
+			current[0].Value)
+	}
+
+	if len(expired) > 0 {
+		if err = obj.RemoveMetadata(expired); err != nil {
+			return err
+		}
+	}
+
+	lock := AVU{Attr: LockAttr, Value: fmt.Sprintf("%s %s", lockHolder,
+		now.Add(ttl).UTC().Format(time.RFC3339Nano))}
+	if err = obj.AddMetadata([]AVU{lock}); err != nil {
+		return err
+	}
+
+	// Check for another lock added concurrently
+	if current, _, err = obj.locks(now); err != nil {
+		return err
+	}
+	if len(current) > 1 {
+		if rerr := obj.RemoveMetadata([]AVU{lock}); rerr != nil {
+			return rerr
+		}
+		return errors.Wrapf(errLocked, "'%s' was locked concurrently",
+			obj.RodsPath())
+	}
+
+	return err
+}
+
+// Unlock removes any locks on the data object held by this process. It is not
+// an error to unlock a data object that is not locked.
+func (obj *DataObject) Unlock() error {
+	avus, err := obj.FetchMetadata()
+	if err != nil {
+		return err
+	}
+
+	var held []AVU
+	for _, avu := range avus {
+		if avu.Attr == LockAttr && strings.HasPrefix(avu.Value, lockHolder+" ") {
+			held = append(held, avu)
+		}
+	}
+	if len(held) == 0 {
+		return err
+	}
+
+	return obj.RemoveMetadata(held)
+}
+
+// locks returns the lock AVUs of the data object, freshly fetched from the
+// server, that are current and those that have expired at the time now. Lock
+// AVUs whose expiry cannot be parsed are treated as current.
+func (obj *DataObject) locks(now time.Time) (current []AVU, expired []AVU,
+	err error) {
+	avus, err := obj.FetchMetadata()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, avu := range avus {
+		if avu.Attr != LockAttr {
+			continue
+		}
+
+		i := strings.LastIndex(avu.Value, " ")
+		expiry, perr := time.Parse(time.RFC3339Nano, avu.Value[i+1:])
+		if perr == nil && !expiry.After(now) {
+			expired = append(expired, avu)
+		} else {
+			current = append(current, avu)
+		}
+	}
+
+	return current, expired, err
+}
+
 type replicatePred func(r Replicate) bool
 
 func (obj *DataObject) filterReplicates(pred replicatePred) []Replicate {
@@ -22,12 +22,18 @@
 package extendo_test
 
 import (
+	"encoding/json"
+	"fmt"
+	"os"
 	"path/filepath"
+	"testing"
+	"time"
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 
 	ex "github.com/wtsi-npg/extendo/v2"
+	dcterms "github.com/wtsi-npg/extendo/v2/dublincore"
 )
 
 var _ = Describe("Make an existing DataObject instance from iRODS", func() {
@@ -77,6 +83,60 @@ var _ = Describe("Make an existing DataObject instance from iRODS", func() {
 	})
 })
 
+var _ = Describe("Attach a client to a deserialised DataObject", func() {
+	var (
+		client *ex.Client
+		err    error
+
+		rootColl, workColl string
+		remotePath         string
+	)
+
+	BeforeEach(func() {
+		client, err = ex.FindAndStart(batonArgs...)
+		Expect(err).NotTo(HaveOccurred())
+
+		rootColl = "/testZone/home/irods"
+		workColl = tmpRodsPath(rootColl, "ExtendoDataObjectWithClient")
+
+		err = putTestData("testdata/", workColl)
+		Expect(err).NotTo(HaveOccurred())
+
+		remotePath = filepath.Join(workColl, "testdata/1/reads/fast5/reads1.fast5")
+	})
+
+	AfterEach(func() {
+		err = removeTmpCollection(workColl)
+		Expect(err).NotTo(HaveOccurred())
+
+		client.StopIgnoreError()
+	})
+
+	When("a data object is unmarshalled from JSON", func() {
+		var obj *ex.DataObject
+
+		BeforeEach(func() {
+			var item ex.RodsItem
+			doc := fmt.Sprintf(`{"collection":"%s","data_object":"%s"}`,
+				filepath.Dir(remotePath), filepath.Base(remotePath))
+			err = json.Unmarshal([]byte(doc), &item)
+			Expect(err).NotTo(HaveOccurred())
+
+			obj = &ex.DataObject{RodsItem: &item}
+		})
+
+		It("should fail to perform operations", func() {
+			_, err = obj.Exists()
+			Expect(err).To(MatchError(ContainSubstring("no associated client")))
+		})
+
+		It("should perform operations once a client is attached", func() {
+			Expect(obj.WithClient(client).Exists()).To(BeTrue())
+			Expect(obj.FetchChecksum()).To(Equal("1181c1834012245d785120e3505ed169"))
+		})
+	})
+})
+
 var _ = Describe("Report that a DataObject exists", func() {
 	var (
 		client *ex.Client
@@ -188,6 +248,189 @@ var _ = Describe("Put a DataObject into iRODS", func() {
 			Expect(obj.Checksum()).To(Equal("1181c1834012245d785120e3505ed169"))
 		})
 	})
+
+	When("a new data object has just been put into iRODS", func() {
+		It("should have a near-zero age", func() {
+			localPath := "testdata/1/reads/fast5/reads1.fast5"
+			remotePath := filepath.Join(workColl, "testdata/testdir/reads1.fast5")
+
+			obj, err := ex.PutDataObject(client, localPath, remotePath)
+			Expect(err).ToNot(HaveOccurred())
+
+			age, err := obj.Age()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(age).To(BeNumerically("<", time.Minute))
+			Expect(obj.IsOlderThan(time.Minute)).To(BeFalse())
+			Expect(obj.Timestamps()).NotTo(BeEmpty())
+		})
+	})
+
+	When("a data object is put only if newer", func() {
+		var localPath, remotePath string
+
+		BeforeEach(func() {
+			remotePath = filepath.Join(workColl, "testdata/1/reads/fast5/reads1.fast5")
+
+			// A local file with different content, made to look older than
+			// the data object
+			localPath = filepath.Join(GinkgoT().TempDir(), "reads1.fast5")
+			err = os.WriteFile(localPath, []byte("old\n"), 0644)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		When("the data object is newer than the local file", func() {
+			BeforeEach(func() {
+				past := time.Now().Add(-time.Hour)
+				err = os.Chtimes(localPath, past, past)
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			It("should not be put", func() {
+				obj, put, err := ex.PutDataObjectIfNewer(client, localPath, remotePath)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(put).To(BeFalse())
+				Expect(obj.RodsPath()).To(Equal(remotePath))
+				Expect(obj.Checksum()).To(Equal("1181c1834012245d785120e3505ed169"))
+			})
+		})
+
+		When("the data object is older than the local file", func() {
+			BeforeEach(func() {
+				future := time.Now().Add(time.Hour)
+				err = os.Chtimes(localPath, future, future)
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			It("should be put", func() {
+				obj, put, err := ex.PutDataObjectIfNewer(client, localPath, remotePath)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(put).To(BeTrue())
+				Expect(obj.Checksum()).NotTo(Equal("1181c1834012245d785120e3505ed169"))
+			})
+		})
+
+		When("the data object does not exist", func() {
+			It("should be put", func() {
+				newPath := filepath.Join(workColl, "testdata/testdir/reads1.fast5")
+				obj, put, err := ex.PutDataObjectIfNewer(client, localPath, newPath)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(put).To(BeTrue())
+				Expect(obj.Exists()).To(BeTrue())
+			})
+		})
+	})
+})
+
+var _ = Describe("Put a DataObject into iRODS, setting ACLs", func() {
+	var (
+		client *ex.Client
+		err    error
+
+		rootColl, workColl string
+
+		coll       *ex.Collection
+		irodsOwn   = ex.ACL{Owner: "irods", Level: ex.ACLOwn, Zone: "testZone"}
+		publicRead = ex.ACL{Owner: "public", Level: ex.ACLRead, Zone: "testZone"}
+		localPath  = "testdata/1/reads/fast5/reads1.fast5"
+	)
+
+	BeforeEach(func() {
+		client, err = ex.FindAndStart(batonArgs...)
+		Expect(err).NotTo(HaveOccurred())
+
+		rootColl = "/testZone/home/irods"
+		workColl = tmpRodsPath(rootColl, "ExtendoPutDataObjectACLs")
+
+		coll, err = ex.MakeCollection(client, filepath.Join(workColl, "inherit"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(coll.AddACLs([]ex.ACL{publicRead})).To(Succeed())
+		Expect(coll.SetInheritance(true)).To(Succeed())
+	})
+
+	AfterEach(func() {
+		err = removeTmpCollection(workColl)
+		Expect(err).NotTo(HaveOccurred())
+
+		client.StopIgnoreError()
+	})
+
+	When("a data object is put into a collection with inherited ACLs", func() {
+		It("should inherit the collection's ACLs by default", func() {
+			obj, err := ex.PutDataObject(client, localPath,
+				filepath.Join(coll.RodsPath(), "reads1.fast5"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(obj.FetchACLs()).To(ContainElement(publicRead))
+		})
+
+		It("should have only the requested ACLs when they are set", func() {
+			obj, err := ex.PutDataObjectWithACLs(client, localPath,
+				filepath.Join(coll.RodsPath(), "reads1.fast5"), []ex.ACL{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(obj.ACLs()).To(ConsistOf(irodsOwn))
+
+			publicWrite := ex.ACL{Owner: "public", Level: ex.ACLWrite, Zone: "testZone"}
+			obj, err = ex.PutDataObjectWithACLs(client, localPath,
+				filepath.Join(coll.RodsPath(), "reads2.fast5"),
+				[]ex.ACL{publicWrite})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(obj.ACLs()).To(ConsistOf(irodsOwn, publicWrite))
+		})
+	})
+})
+
+var _ = Describe("Put a DataObject into iRODS, replacing metadata", func() {
+	var (
+		client *ex.Client
+		err    error
+
+		rootColl, workColl                  string
+		localPath, remotePath, newLocalPath string
+
+		newChecksum = "348bd3ce10ec00ecc29d31ec97cd5839"
+	)
+
+	BeforeEach(func() {
+		client, err = ex.FindAndStart(batonArgs...)
+		Expect(err).NotTo(HaveOccurred())
+
+		rootColl = "/testZone/home/irods"
+		workColl = tmpRodsPath(rootColl, "ExtendoDataObjectPutReplace")
+
+		err = putTestData("testdata/", workColl)
+		Expect(err).NotTo(HaveOccurred())
+
+		localPath = "testdata/1/reads/fast5/reads1.fast5"
+		remotePath = filepath.Join(workColl, "testdata/testdir/reads99.fast5")
+
+		newLocalPath = "testdata/1/reads/fast5/reads2.fast5"
+	})
+
+	AfterEach(func() {
+		err = removeTmpCollection(workColl)
+		Expect(err).NotTo(HaveOccurred())
+
+		client.StopIgnoreError()
+	})
+
+	When("overwriting a data object that has metadata", func() {
+		It("should replace the metadata and have the new checksum", func() {
+			old := []ex.AVU{{Attr: "x", Value: "old"}, {Attr: "c", Value: "d"}}
+			_, err := ex.PutDataObject(client, localPath, remotePath, old)
+			Expect(err).NotTo(HaveOccurred())
+
+			obj, err := ex.PutReplaceDataObject(client, newLocalPath,
+				remotePath, []ex.AVU{{Attr: "x", Value: "y"}})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(obj.Checksum()).To(Equal(newChecksum))
+
+			expected := []ex.AVU{{Attr: "c", Value: "d"}, {Attr: "x", Value: "y"}}
+			Expect(obj.Metadata()).To(ConsistOf(expected))
+
+			avus, err := obj.FetchMetadata()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(avus).To(ConsistOf(expected))
+		})
+	})
 })
 
 var _ = Describe("Archive a DataObject into iRODS", func() {
@@ -297,6 +540,28 @@ var _ = Describe("Archive a DataObject into iRODS", func() {
 				expected := ex.SetUnionAVUs(creationMeta, extraMeta)
 				Expect(avus).To(ConsistOf(expected))
 			})
+
+			It("should replace existing metadata using only put, list, rem and add", func() {
+				old := []ex.AVU{{Attr: "x", Value: "old"}, {Attr: "c", Value: "d"}}
+				_, err := ex.ArchiveDataObject(client, localPath, remotePath,
+					checksum, old)
+				Expect(err).NotTo(HaveOccurred())
+
+				extraMeta := []ex.AVU{{Attr: "x", Value: "y"}}
+				before := client.OperationCount()
+				obj, err := ex.ArchiveDataObject(client, newLocalPath,
+					remotePath, newChecksum, extraMeta)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(client.OperationCount() - before).To(Equal(uint64(4)))
+
+				Expect(obj.Metadata()).To(ConsistOf(
+					ex.AVU{Attr: "x", Value: "y"}, ex.AVU{Attr: "c", Value: "d"}))
+
+				avus, err := obj.FetchMetadata()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(avus).To(ConsistOf(
+					ex.AVU{Attr: "x", Value: "y"}, ex.AVU{Attr: "c", Value: "d"}))
+			})
 		})
 	})
 
@@ -502,6 +767,60 @@ var _ = Describe("Inspect metadata on an DataObject", func() {
 	})
 })
 
+var _ = Describe("Append provenance to a DataObject", func() {
+	var (
+		client *ex.Client
+		err    error
+
+		rootColl, workColl string
+
+		obj *ex.DataObject
+	)
+
+	BeforeEach(func() {
+		client, err = ex.FindAndStart(batonArgs...)
+		Expect(err).NotTo(HaveOccurred())
+
+		rootColl = "/testZone/home/irods"
+		workColl = tmpRodsPath(rootColl, "ExtendoDataObjectProvenance")
+
+		err = putTestData("testdata/", workColl)
+		Expect(err).NotTo(HaveOccurred())
+
+		remotePath := filepath.Join(workColl, "testdata/1/reads/fast5/reads1.fast5")
+		obj = ex.NewDataObject(client, remotePath)
+	})
+
+	AfterEach(func() {
+		err = removeTmpCollection(workColl)
+		Expect(err).NotTo(HaveOccurred())
+
+		client.StopIgnoreError()
+	})
+
+	When("two provenance steps are appended", func() {
+		It("should retain both, with timestamps", func() {
+			Expect(obj.AppendProvenance("basecall", "guppy 4.2.2")).To(Succeed())
+			Expect(obj.AppendProvenance("align", "minimap2 2.17")).To(Succeed())
+
+			avus, err := obj.FetchMetadata()
+			Expect(err).NotTo(HaveOccurred())
+
+			var values []string
+			for _, avu := range avus {
+				if avu.Attr == dcterms.Provenance {
+					values = append(values, avu.Value)
+				}
+			}
+			Expect(values).To(HaveLen(2))
+			Expect(values).To(ContainElement(
+				MatchRegexp(`^\d{4}-\d{2}-\d{2}T\S+Z basecall: guppy 4\.2\.2$`)))
+			Expect(values).To(ContainElement(
+				MatchRegexp(`^\d{4}-\d{2}-\d{2}T\S+Z align: minimap2 2\.17$`)))
+		})
+	})
+})
+
 var _ = Describe("Replace metadata on a DataObject", func() {
 	var (
 		client *ex.Client
@@ -562,3 +881,163 @@ var _ = Describe("Replace metadata on a DataObject", func() {
 		})
 	})
 })
+
+var _ = Describe("Sync a DataObject with iRODS", func() {
+	var (
+		client *ex.Client
+		err    error
+
+		rootColl, workColl string
+
+		obj *ex.DataObject
+
+		testChecksum = "1181c1834012245d785120e3505ed169"
+		avu          = ex.AVU{Attr: "test_attr_sync", Value: "1"}
+	)
+
+	BeforeEach(func() {
+		client, err = ex.FindAndStart(batonArgs...)
+		Expect(err).NotTo(HaveOccurred())
+
+		rootColl = "/testZone/home/irods"
+		workColl = tmpRodsPath(rootColl, "ExtendoDataObjectSync")
+
+		err = putTestData("testdata/", workColl)
+		Expect(err).NotTo(HaveOccurred())
+
+		remotePath := filepath.Join(workColl, "testdata/1/reads/fast5/reads1.fast5")
+		obj = ex.NewDataObject(client, remotePath)
+
+		_, err = obj.FetchMetadata()
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		err = removeTmpCollection(workColl)
+		Expect(err).NotTo(HaveOccurred())
+
+		client.StopIgnoreError()
+	})
+
+	When("the metadata are changed by another client", func() {
+		BeforeEach(func() {
+			other := ex.RodsItem{IPath: obj.IPath, IName: obj.IName,
+				IAVUs: []ex.AVU{avu}}
+			_, err = client.MetaAdd(ex.Args{}, other)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("should have stale metadata until synced", func() {
+			Expect(obj.HasMetadatum(avu)).To(BeFalse())
+
+			err = obj.Sync(ex.Args{AVU: true, ACL: true, Checksum: true})
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(obj.HasMetadatum(avu)).To(BeTrue())
+			Expect(obj.ACLs()).NotTo(BeEmpty())
+			Expect(obj.Checksum()).To(Equal(testChecksum))
+		})
+	})
+})
+
+var _ = Describe("Replace metadata on a DataObject if unchanged", func() {
+	var (
+		client *ex.Client
+		err    error
+
+		rootColl, workColl string
+
+		obj *ex.DataObject
+
+		initial = []ex.AVU{{Attr: "test_attr_a", Value: "1"},
+			{Attr: "test_attr_b", Value: "2"}}
+		desired = []ex.AVU{{Attr: "test_attr_b", Value: "3"},
+			{Attr: "test_attr_c", Value: "4"}}
+	)
+
+	BeforeEach(func() {
+		client, err = ex.FindAndStart(batonArgs...)
+		Expect(err).NotTo(HaveOccurred())
+
+		rootColl = "/testZone/home/irods"
+		workColl = tmpRodsPath(rootColl, "ExtendoReplaceIfUnchanged")
+
+		err = putTestData("testdata/", workColl)
+		Expect(err).NotTo(HaveOccurred())
+
+		remotePath := filepath.Join(workColl, "testdata/1/reads/fast5/reads1.fast5")
+		obj = ex.NewDataObject(client, remotePath)
+		err = obj.AddMetadata(initial)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		err = removeTmpCollection(workColl)
+		Expect(err).NotTo(HaveOccurred())
+
+		client.StopIgnoreError()
+	})
+
+	When("the current metadata are as expected", func() {
+		It("should replace them", func() {
+			err = obj.ReplaceMetadataIfUnchanged(initial, desired)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(obj.Metadata()).To(ConsistOf(desired))
+
+			avus, err := obj.FetchMetadata()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(avus).To(ConsistOf(desired))
+		})
+	})
+
+	When("the current metadata have been changed", func() {
+		BeforeEach(func() {
+			other := ex.NewDataObject(client, obj.RodsPath())
+			err = other.AddMetadata([]ex.AVU{{Attr: "test_attr_x", Value: "y"}})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("should return a conflict error and not replace them", func() {
+			err = obj.ReplaceMetadataIfUnchanged(initial, desired)
+			Expect(err).To(HaveOccurred())
+			Expect(ex.IsMetadataConflict(err)).To(BeTrue())
+
+			avus, err := obj.FetchMetadata()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(avus).To(ConsistOf(append(initial,
+				ex.AVU{Attr: "test_attr_x", Value: "y"})))
+		})
+	})
+})
+
+func BenchmarkArchiveDataObject(b *testing.B) {
+	client, err := ex.FindAndStart(batonArgs...)
+	if err != nil {
+		b.Skipf("baton-do is not available: %v", err)
+	}
+	defer client.StopIgnoreError()
+
+	workColl := tmpRodsPath("/testZone/home/irods", "ExtendoBenchmarkArchive")
+	if _, err = client.MkDir(ex.Args{Recurse: true},
+		ex.RodsItem{IPath: workColl}); err != nil {
+		b.Fatal(err)
+	}
+	defer func() {
+		if err := removeTmpCollection(workColl); err != nil {
+			b.Error(err)
+		}
+	}()
+
+	localPath := "testdata/1/reads/fast5/reads1.fast5"
+	remotePath := filepath.Join(workColl, "reads1.fast5")
+	checksum := "1181c1834012245d785120e3505ed169"
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		avus := []ex.AVU{{Attr: "x", Value: fmt.Sprintf("%d", i)}}
+		if _, err = ex.ArchiveDataObject(client, localPath, remotePath,
+			checksum, avus); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
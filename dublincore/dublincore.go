@@ -34,6 +34,7 @@ const (
 	Identifier  = "dcterms:identifier"  // http://purl.org/dc/elements/1.1/identifier
 	Language    = "dcterms:language"    // http://purl.org/dc/elements/1.1/language
 	Modified    = "dcterms:modified"    // http://purl.org/dc/elements/1.1/modified
+	Provenance  = "dcterms:provenance"  // http://purl.org/dc/terms/provenance
 	Publisher   = "dcterms:publisher"   // http://purl.org/dc/elements/1.1/publisher
 	Relation    = "dcterms:relation"    // http://purl.org/dc/elements/1.1/relation
 	Rights      = "dcterms:rights"      // http://purl.org/dc/elements/1.1/rights
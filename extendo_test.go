@@ -21,10 +21,19 @@
 package extendo
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/pkg/errors"
 	"github.com/rs/zerolog"
 	"github.com/stretchr/testify/assert"
 	logs "github.com/wtsi-npg/logshim"
@@ -54,6 +63,64 @@ func TestFindBaton(t *testing.T) {
 	}
 }
 
+func TestFindBatonPath(t *testing.T) {
+	dir := t.TempDir()
+	baton := filepath.Join(dir, "baton-do")
+	err := os.WriteFile(baton, []byte("#!/bin/sh\n"), 0755)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	t.Setenv("BATON_DO", "")
+
+	emptyPath := "baton-do cannot be found because PATH is empty or unset; " +
+		"set PATH, or set BATON_DO to the path of baton-do"
+	t.Setenv("PATH", "")
+	_, err = FindBaton()
+	assert.EqualError(t, err, emptyPath)
+
+	_ = os.Unsetenv("PATH")
+	_, err = FindBaton()
+	assert.EqualError(t, err, emptyPath)
+
+	t.Setenv("PATH", "/nonexistent")
+	_, err = FindBaton()
+	assert.EqualError(t, err, "baton-do not present in PATH '/nonexistent'")
+
+	t.Setenv("PATH", "/nonexistent:"+dir)
+	path, err := FindBaton()
+	assert.NoError(t, err)
+	assert.Equal(t, baton, path)
+
+	// Empty elements of PATH are the current working directory
+	wd, err := os.Getwd()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer func() { _ = os.Chdir(wd) }()
+	if !assert.NoError(t, os.Chdir(dir)) {
+		return
+	}
+
+	for _, p := range []string{":/nonexistent", "/nonexistent:", "/nonexistent::/x"} {
+		t.Setenv("PATH", p)
+		path, err = FindBaton()
+		assert.NoError(t, err, "PATH '%s'", p)
+		assert.Equal(t, baton, path, "PATH '%s'", p)
+	}
+
+	// BATON_DO overrides PATH
+	t.Setenv("PATH", "")
+	t.Setenv("BATON_DO", baton)
+	path, err = FindBaton()
+	assert.NoError(t, err)
+	assert.Equal(t, baton, path)
+
+	t.Setenv("BATON_DO", filepath.Join(dir, "nonexistent"))
+	_, err = FindBaton()
+	assert.Error(t, err)
+}
+
 func TestStartClient(t *testing.T) {
 	bc, err := FindAndStart()
 	if assert.NoError(t, err, "Failed to start baton-do") {
@@ -74,6 +141,48 @@ func TestStopClient(t *testing.T) {
 	}
 }
 
+func TestStopNotStarted(t *testing.T) {
+	client, err := NewClient("sleep")
+	if assert.NoError(t, err) {
+		assert.NotPanics(t, func() {
+			assert.NoError(t, client.Stop())
+			assert.NoError(t, client.Stop())
+		})
+	}
+}
+
+func TestStopLogging(t *testing.T) {
+	zl, ok := logs.GetLogger().(*zlog.ZeroLogger)
+	if !assert.True(t, ok) {
+		return
+	}
+	var buf bytes.Buffer
+	saved := zl.Logger
+	logger := zerolog.New(&buf).Level(zerolog.ErrorLevel)
+	zl.Logger = &logger
+	defer func() { zl.Logger = saved }()
+
+	startSh := func(script string) *Client {
+		client, err := NewClient("sh")
+		if assert.NoError(t, err) {
+			_, err = client.Start("-c", script)
+			assert.NoError(t, err)
+		}
+		return client
+	}
+
+	// A clean stop is not logged
+	startSh("cat >/dev/null").StopIgnoreError()
+	assert.Empty(t, buf.String())
+
+	// An unclean stop is logged, unless quietly
+	startSh("cat >/dev/null; exit 3").StopQuietly()
+	assert.Empty(t, buf.String())
+
+	startSh("cat >/dev/null; exit 3").StopIgnoreError()
+	assert.Contains(t, buf.String(), "client did not stop cleanly")
+}
+
 func TestIsRunning(t *testing.T) {
 	bc, err := FindAndStart()
 	if assert.NoError(t, err, "Failed to start baton-do") {
@@ -108,6 +217,22 @@ func TestIsLocalFile(t *testing.T) {
 	assert.True(t, file1.IsLocalFile())
 }
 
+func TestLocalFileExists(t *testing.T) {
+	for _, c := range []struct {
+		item   RodsItem
+		exists bool
+	}{
+		{RodsItem{IDirectory: "testdata/1/reads/fast5", IFile: "reads1.fast5"}, true},
+		{RodsItem{IDirectory: "testdata/1/reads/fast5", IFile: "reads9.fast5"}, false},
+		{RodsItem{IDirectory: "testdata/1/reads", IFile: "fast5"}, false},
+		{RodsItem{IDirectory: "testdata/1/reads/fast5"}, false},
+	} {
+		exists, err := c.item.LocalFileExists()
+		assert.NoError(t, err)
+		assert.Equal(t, c.exists, exists, "%s", c.item.LocalPath())
+	}
+}
+
 func TestIsCollection(t *testing.T) {
 	root := &RodsItem{IPath: "/testZone"}
 	assert.True(t, root.IsCollection())
@@ -124,6 +249,128 @@ func TestIsDataObject(t *testing.T) {
 	assert.True(t, file1.IsDataObject())
 }
 
+func TestNewCollectionPath(t *testing.T) {
+	paths := map[string]string{
+		"/testZone/home/irods":      "/testZone/home/irods",
+		"/testZone/home/irods/":     "/testZone/home/irods",
+		"/testZone//home///irods//": "/testZone/home/irods",
+		"/testZone/home/./irods":    "/testZone/home/irods",
+		"/testZone/home/irods/.":    "/testZone/home/irods",
+		"/testZone/home/x/../irods": "/testZone/home/irods",
+		"/":                         "/",
+	}
+
+	for path, expected := range paths {
+		coll := NewCollection(nil, path)
+		assert.Equal(t, expected, coll.RodsPath(), "path %s", path)
+		assert.True(t, coll.IsCollection())
+	}
+}
+
+func TestNewCollectionLeavesZone(t *testing.T) {
+	client := newEchoingClient(t, func(request *Envelope) {})
+
+	for _, path := range []string{"/testZone/../../home/irods/",
+		"/testZone/../otherZone", "/testZone/home/../../.."} {
+		coll := NewCollection(client, path)
+		assert.Equal(t, path, coll.IPath)
+
+		_, err := coll.client.ListItem(Args{}, *coll.RodsItem)
+		if assert.Error(t, err, "path %s", path) {
+			assert.Contains(t, err.Error(), "leaves its zone")
+		}
+		_, err = MakeCollection(client, path)
+		assert.Error(t, err, "path %s", path)
+	}
+
+	coll := NewCollection(client, "/testZone/home/../irods")
+	_, err := coll.client.ListItem(Args{}, *coll.RodsItem)
+	assert.NoError(t, err)
+}
+
+func TestACLLevelRank(t *testing.T) {
+	assert.Equal(t, 0, ACLLevelRank(ACLNull))
+	assert.Equal(t, 1, ACLLevelRank(ACLRead))
+	assert.Equal(t, 2, ACLLevelRank(ACLWrite))
+	assert.Equal(t, 3, ACLLevelRank(ACLOwn))
+
+	for _, level := range []string{"admin", ACLInherit, ""} {
+		assert.Greater(t, ACLLevelRank(level), ACLLevelRank(ACLOwn))
+	}
+}
+
+func TestSortReplicates(t *testing.T) {
+	reps := []Replicate{
+		{Resource: "b", Location: "a", Number: 0},
+		{Resource: "a", Location: "b", Number: 0},
+		{Resource: "a", Location: "a", Number: 2, Checksum: "a"},
+		{Resource: "a", Location: "a", Number: 1, Checksum: "b"},
+		{Resource: "a", Location: "a", Number: 1, Checksum: "a"},
+		{Resource: "a", Location: "a", Number: 1, Checksum: "a", Valid: true},
+	}
+	SortReplicates(reps)
+
+	assert.Equal(t, []Replicate{
+		{Resource: "a", Location: "a", Number: 1, Checksum: "a", Valid: true},
+		{Resource: "a", Location: "a", Number: 1, Checksum: "a"},
+		{Resource: "a", Location: "a", Number: 1, Checksum: "b"},
+		{Resource: "a", Location: "a", Number: 2, Checksum: "a"},
+		{Resource: "a", Location: "b", Number: 0},
+		{Resource: "b", Location: "a", Number: 0},
+	}, reps)
+}
+
+func TestSortACLs(t *testing.T) {
+	acls := []ACL{
+		{Owner: "public", Level: "admin", Zone: "testZone"},
+		{Owner: "public", Level: ACLOwn, Zone: "testZone"},
+		{Owner: "public", Level: ACLRead, Zone: "testZone"},
+		{Owner: "irods", Level: ACLWrite, Zone: "testZone"},
+		{Owner: "public", Level: ACLWrite, Zone: "testZone"},
+		{Owner: "public", Level: ACLNull, Zone: "otherZone"},
+	}
+	SortACLs(acls)
+
+	assert.Equal(t, []ACL{
+		{Owner: "public", Level: ACLNull, Zone: "otherZone"},
+		{Owner: "irods", Level: ACLWrite, Zone: "testZone"},
+		{Owner: "public", Level: ACLRead, Zone: "testZone"},
+		{Owner: "public", Level: ACLWrite, Zone: "testZone"},
+		{Owner: "public", Level: ACLOwn, Zone: "testZone"},
+		{Owner: "public", Level: "admin", Zone: "testZone"},
+	}, acls)
+}
+
+func TestFilterItemsByACL(t *testing.T) {
+	none := RodsItem{IPath: "/testZone/none"}
+	null := RodsItem{IPath: "/testZone/null",
+		IACLs: []ACL{{Owner: "public", Level: "null", Zone: "testZone"}}}
+	read := RodsItem{IPath: "/testZone/read",
+		IACLs: []ACL{
+			{Owner: "irods", Level: "own", Zone: "testZone"},
+			{Owner: "public", Level: "read", Zone: "testZone"}}}
+	write := RodsItem{IPath: "/testZone/write",
+		IACLs: []ACL{{Owner: "public", Level: "write", Zone: "testZone"}}}
+	own := RodsItem{IPath: "/testZone/own",
+		IACLs: []ACL{{Owner: "public", Level: "own", Zone: "testZone"}}}
+
+	items := []RodsItem{none, null, read, write, own}
+
+	assert.Equal(t, []RodsItem{null, read, write, own},
+		FilterItemsByACL(items, "public", "null"))
+	assert.Equal(t, []RodsItem{read, write, own},
+		FilterItemsByACL(items, "public", "read"))
+	assert.Equal(t, []RodsItem{write, own},
+		FilterItemsByACL(items, "public", "write"))
+	assert.Equal(t, []RodsItem{own}, FilterItemsByACL(items, "public", "own"))
+
+	// Only the owner's access counts
+	assert.Equal(t, []RodsItem{read}, FilterItemsByACL(items, "irods", "write"))
+	assert.Empty(t, FilterItemsByACL(items, "nobody", "null"))
+
+	assert.Empty(t, FilterItemsByACL(items, "public", "admin"))
+}
+
 func TestSearchAVU(t *testing.T) {
 	avu0 := AVU{Attr: "x", Value: "y", Units: "z"}
 	avu1 := AVU{Attr: "a", Value: "b", Units: "z"}
@@ -143,6 +390,72 @@ func TestSearchAVU(t *testing.T) {
 	assert.False(t, SearchAVU(AVU{Attr: "f", Value: "g"}, avus))
 }
 
+func TestAVUOperatorIgnored(t *testing.T) {
+	stored := AVU{Attr: "a", Value: "b", Units: "z"}
+	query := AVU{Attr: "a", Value: "b", Units: "z", Operator: "="}
+	other := AVU{Attr: "a", Value: "c", Units: "z", Operator: "="}
+
+	item := &RodsItem{IAVUs: []AVU{stored}}
+	assert.True(t, item.HasMetadatum(query))
+	assert.False(t, item.HasMetadatum(other))
+	assert.True(t, item.HasSomeMetadata([]AVU{other, query}))
+	assert.True(t, item.HasAllMetadata([]AVU{query}))
+	assert.False(t, item.HasAllMetadata([]AVU{query, other}))
+
+	assert.True(t, SearchAVU(query, []AVU{stored}))
+	assert.Equal(t, []AVU{stored},
+		SetIntersectAVUs([]AVU{query}, []AVU{stored}))
+	assert.Equal(t, []AVU{stored},
+		SetUnionAVUs([]AVU{stored}, []AVU{query}))
+	assert.Empty(t, SetDiffAVUs([]AVU{stored}, []AVU{query}))
+	assert.Equal(t, []AVU{stored}, UniqAVUsStable([]AVU{stored, query}))
+}
+
+func TestMakeProvenanceAVU(t *testing.T) {
+	when := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+	avu := MakeProvenanceAVU("basecall", "guppy 4.2.2", when)
+
+	assert.Equal(t, AVU{Attr: "dcterms:provenance",
+		Value: "2021-03-04T05:06:07.000000000Z basecall: guppy 4.2.2"}, avu)
+	assert.NotEqual(t, avu,
+		MakeProvenanceAVU("basecall", "guppy 4.2.2", when.Add(time.Millisecond)))
+
+	// Values sort lexically in time order, including those with fractional
+	// seconds that have trailing zeros
+	local := time.FixedZone("UTC+1", 3600)
+	times := []time.Time{
+		when,
+		when.Add(100 * time.Millisecond),
+		when.Add(120 * time.Millisecond),
+		when.Add(time.Second),
+		when.Add(time.Hour).In(local),
+	}
+	var values []string
+	for _, tm := range times {
+		values = append(values, MakeProvenanceAVU("x", "y", tm).Value)
+	}
+	assert.True(t, sort.StringsAreSorted(values), "%v", values)
+}
+
+func TestAVUUnitsDistinct(t *testing.T) {
+	noUnits := AVU{Attr: "a", Value: "1"}
+	withUnits := AVU{Attr: "a", Value: "1", Units: "bp"}
+
+	item := &RodsItem{IAVUs: []AVU{noUnits}}
+	assert.True(t, item.HasMetadatum(noUnits))
+	assert.False(t, item.HasMetadatum(withUnits))
+
+	item = &RodsItem{IAVUs: []AVU{withUnits}}
+	assert.False(t, item.HasMetadatum(noUnits))
+	assert.True(t, item.HasMetadatum(withUnits))
+
+	both := []AVU{noUnits, withUnits}
+	assert.Empty(t, SetIntersectAVUs([]AVU{noUnits}, []AVU{withUnits}))
+	assert.Len(t, SetUnionAVUs([]AVU{noUnits}, []AVU{withUnits}), 2)
+	assert.Equal(t, []AVU{noUnits}, SetDiffAVUs(both, []AVU{withUnits}))
+	assert.Len(t, UniqAVUs(both), 2)
+}
+
 func TestSetIntersectAVUs(t *testing.T) {
 	avu0 := AVU{Attr: "x", Value: "y", Units: "z"}
 	avu1 := AVU{Attr: "a", Value: "b", Units: "z"}
@@ -192,6 +505,158 @@ func TestUniqAVUs(t *testing.T) {
 	assert.Equal(t, UniqAVUs(avus), expected)
 }
 
+func TestUniqAVUsStable(t *testing.T) {
+	avu0 := AVU{Attr: "x", Value: "y", Units: "z"}
+	avu1 := AVU{Attr: "a", Value: "b", Units: "z"}
+	avu2 := AVU{Attr: "w", Value: "x", Units: "z"}
+
+	avus := []AVU{avu1, avu2, avu0, avu0, avu1, avu0, avu1}
+
+	assert.Equal(t, []AVU{avu1, avu2, avu0}, UniqAVUsStable(avus))
+	assert.Empty(t, UniqAVUsStable(nil))
+}
+
+func TestCanonicalAVUs(t *testing.T) {
+	x := []AVU{
+		{Attr: "b", Value: "2"},
+		{Attr: " a", Value: "1 ", Units: "z"},
+		{Attr: "b", Value: "2", Operator: "="}}
+	y := []AVU{
+		{Attr: "a", Value: "1", Units: " z\t"},
+		{Attr: "b", Value: "\t2\n"}}
+
+	assert.Equal(t, []AVU{
+		{Attr: "a", Value: "1", Units: "z"},
+		{Attr: "b", Value: "2"}}, CanonicalAVUs(x))
+	assert.Equal(t, CanonicalAVUs(x), CanonicalAVUs(y))
+	assert.Empty(t, CanonicalAVUs(nil))
+}
+
+func TestNormalizeAVUCase(t *testing.T) {
+	avus := []AVU{
+		{Attr: "Sample", Value: "ABC", Units: "Z"},
+		{Attr: "sample", Value: "abc"},
+		{Attr: "STUDY", Value: "1", Operator: "="}}
+
+	assert.Equal(t, []AVU{
+		{Attr: "sample", Value: "ABC", Units: "Z"},
+		{Attr: "sample", Value: "abc"},
+		{Attr: "study", Value: "1", Operator: "="}}, NormalizeAVUCase(avus))
+	assert.Equal(t, "Sample", avus[0].Attr)
+	assert.Empty(t, NormalizeAVUCase(nil))
+}
+
+func TestAVUsFromMap(t *testing.T) {
+	avus := AVUsFromMap(map[string]string{"b": "2", "a": "1", "c": "3"})
+	assert.Equal(t, []AVU{
+		{Attr: "a", Value: "1"},
+		{Attr: "b", Value: "2"},
+		{Attr: "c", Value: "3"}}, avus)
+
+	assert.Empty(t, AVUsFromMap(map[string]string{}))
+}
+
+func TestAVUsFromMultiMap(t *testing.T) {
+	avus := AVUsFromMultiMap(map[string][]string{
+		"b": {"2"},
+		"a": {"3", "1", "3"},
+		"c": {},
+	})
+	assert.Equal(t, []AVU{
+		{Attr: "a", Value: "1"},
+		{Attr: "a", Value: "3"},
+		{Attr: "b", Value: "2"}}, avus)
+}
+
+func TestSortAVUs(t *testing.T) {
+	avus := []AVU{
+		{Attr: "b", Value: "a"},
+		{Attr: "a", Value: "b", Units: "x"},
+		{Attr: "a", Value: "b"},
+		{Attr: "a", Value: "c"},
+	}
+	SortAVUs(avus)
+
+	assert.Equal(t, []AVU{
+		{Attr: "a", Value: "b"},
+		{Attr: "a", Value: "b", Units: "x"},
+		{Attr: "a", Value: "c"},
+		{Attr: "b", Value: "a"},
+	}, avus)
+}
+
+func TestCompareMetadata(t *testing.T) {
+	avu0 := AVU{Attr: "a", Value: "1"}
+	avu1 := AVU{Attr: "a", Value: "2"}
+	avu2 := AVU{Attr: "b", Value: "1"}
+	avu3 := AVU{Attr: "c", Value: "1"}
+
+	// A sub-process holding the current metadata of the item
+	var stored []AVU
+	client := newEchoingClient(t, func(request *Envelope) {
+		assert.Equal(t, LIST, request.Operation)
+		assert.True(t, request.Arguments.AVU)
+		request.Target.IAVUs = append([]AVU{}, stored...)
+	})
+
+	// The cached metadata are stale and are not used
+	item := RodsItem{client: client, IPath: "/testZone", IName: "x",
+		IAVUs: []AVU{avu1, avu3}}
+
+	// Add only; a new attribute does not affect the current AVUs
+	stored = []AVU{avu0, avu2}
+	toAdd, toRemove, err := CompareMetadata(item, []AVU{avu3})
+	assert.NoError(t, err)
+	assert.Equal(t, []AVU{avu3}, toAdd)
+	assert.Empty(t, toRemove)
+
+	// Remove only; the desired AVU is present, so the others with its
+	// attribute are removed
+	stored = []AVU{avu0, avu1, avu2}
+	toAdd, toRemove, err = CompareMetadata(item, []AVU{avu0})
+	assert.NoError(t, err)
+	assert.Empty(t, toAdd)
+	assert.Equal(t, []AVU{avu1}, toRemove)
+
+	// Mixed; avu0 is replaced by avu1, avu2 is untouched and avu3 is added
+	stored = []AVU{avu0, avu2}
+	toAdd, toRemove, err = CompareMetadata(item, []AVU{avu1, avu3})
+	assert.NoError(t, err)
+	assert.Equal(t, []AVU{avu1, avu3}, toAdd)
+	assert.Equal(t, []AVU{avu0}, toRemove)
+
+	// No change
+	toAdd, toRemove, err = CompareMetadata(item, []AVU{avu0, avu2})
+	assert.NoError(t, err)
+	assert.Empty(t, toAdd)
+	assert.Empty(t, toRemove)
+
+	assert.Equal(t, []AVU{avu1, avu3}, item.IAVUs)
+
+	// Without a client, the current metadata cannot be fetched
+	_, _, err = CompareMetadata(RodsItem{IPath: "/testZone", IName: "x"},
+		[]AVU{avu0})
+	assert.Error(t, err)
+}
+
+func TestAVU_Validate(t *testing.T) {
+	assert.NoError(t, AVU{Attr: "x", Value: "y"}.Validate())
+	assert.NoError(t, AVU{Attr: "x", Value: "y z", Units: "bp"}.Validate())
+	assert.NoError(t, AVU{Attr: "x", Value: "ünïcödé"}.Validate())
+
+	assert.Error(t, AVU{Attr: "", Value: "y"}.Validate())
+	assert.Error(t, AVU{Attr: "x", Value: ""}.Validate())
+	assert.Error(t, AVU{Attr: "x", Value: "\xff"}.Validate())
+
+	err := AVU{Attr: "x", Value: "a\nb"}.Validate()
+	if assert.Error(t, err) {
+		assert.Regexp(t, `value contains control character '\\n' at byte 1`,
+			err.Error())
+	}
+	assert.Error(t, AVU{Attr: "x\ty", Value: "y"}.Validate())
+	assert.Error(t, AVU{Attr: "x", Value: "y", Units: "\r"}.Validate())
+}
+
 func TestAVU_HasNamespace(t *testing.T) {
 	assert.False(t, AVU{Attr:"x",Value: "y"}.HasNamespace())
 	assert.False(t, AVU{Attr:":x", Value:"y"}.HasNamespace())
@@ -223,3 +688,1546 @@ func TestAVU_NamespacedAttr(t *testing.T) {
 	avu1 := AVU{Attr: "x", Value: "y", Units: "z"}
 	assert.Equal(t, "x", avu1.WithoutNamespace())
 }
+
+func TestFilterByUnits(t *testing.T) {
+	withUnits := RodsItem{IPath: "/testZone", IName: "x",
+		IAVUs: []AVU{{Attr: "length", Value: "100", Units: "bp"}}}
+	withoutUnits := RodsItem{IPath: "/testZone", IName: "y",
+		IAVUs: []AVU{{Attr: "length", Value: "100"}}}
+	items := []RodsItem{withUnits, withoutUnits}
+
+	match := filterByUnits(items,
+		[]AVU{{Attr: "length", Value: "100", Units: "bp"}})
+	assert.Equal(t, []RodsItem{withUnits}, match)
+
+	match = filterByUnits(items, []AVU{{Attr: "length", Value: "100"}})
+	assert.Equal(t, []RodsItem{withoutUnits}, match)
+
+	match = filterByUnits(items,
+		[]AVU{{Attr: "length", Value: "50", Units: "bp", Operator: ">"}})
+	assert.Equal(t, []RodsItem{withUnits}, match)
+
+	assert.Empty(t, filterByUnits(items,
+		[]AVU{{Attr: "length", Value: "100", Units: "reads"}}))
+}
+
+func TestWriteTimeout(t *testing.T) {
+	// sleep never reads its STDIN, so once the pipe buffer is full any
+	// further write blocks, in the same way as a wedged baton-do would.
+	client, err := NewClient("sleep")
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = client.Start("60")
+	if !assert.NoError(t, err) {
+		return
+	}
+	client.writeTimeout = 100 * time.Millisecond
+
+	// The failed write is logged with the request; keep it out of the test
+	// output
+	zl, ok := logs.GetLogger().(*zlog.ZeroLogger)
+	if !assert.True(t, ok) {
+		return
+	}
+	saved := zl.Logger
+	logger := zerolog.Nop()
+	zl.Logger = &logger
+	defer func() { zl.Logger = saved }()
+
+	// Just over the 64 KiB Linux pipe buffer
+	name := strings.Repeat("x", 65*1024)
+	_, err = client.send(wrap(LIST, Args{}, RodsItem{IPath: "/", IName: name}))
+	assert.Error(t, err)
+	assert.Regexp(t, "did not accept input", err.Error())
+
+	_ = client.Stop()
+	assert.False(t, client.IsRunning())
+}
+
+func TestRodsSubPath(t *testing.T) {
+	for _, root := range []string{"testdata", "testdata/", "./testdata",
+		"/abs/dir/testdata"} {
+		dir := filepath.Join(root, "1/reads")
+		path, err := rodsSubPath(root, "/testZone/coll", dir)
+		if assert.NoError(t, err) {
+			assert.Equal(t, "/testZone/coll/testdata/1/reads", path)
+		}
+	}
+
+	_, err := rodsSubPath("/abs/dir/testdata", "/testZone/coll", "/elsewhere")
+	assert.Error(t, err)
+}
+
+func makeLargeEnvelope(n int) *Envelope {
+	items := make([]RodsItem, n)
+	for i := range items {
+		items[i] = RodsItem{IPath: "/testZone/coll",
+			IName: fmt.Sprintf("obj%08d", n-i),
+			IAVUs: []AVU{{Attr: "b", Value: "2"}, {Attr: "a", Value: "1"}}}
+	}
+
+	return &Envelope{Operation: LIST, Result: &ResultWrapper{List: &items}}
+}
+
+func TestUnwrapUnsorted(t *testing.T) {
+	client := &Client{}
+	assert.True(t, client.SortResults())
+
+	items, err := unwrap(client, makeLargeEnvelope(3))
+	if assert.NoError(t, err) {
+		assert.Equal(t, "obj00000001", items[0].IName)
+		assert.Equal(t, "a", items[0].IAVUs[0].Attr)
+	}
+
+	client.SetSortResults(false)
+	assert.False(t, client.SortResults())
+
+	items, err = unwrap(client, makeLargeEnvelope(3))
+	if assert.NoError(t, err) {
+		assert.Equal(t, "obj00000003", items[0].IName)
+		assert.Equal(t, "b", items[0].IAVUs[0].Attr)
+		assert.Equal(t, client, items[0].client)
+	}
+}
+
+func benchmarkUnwrap(b *testing.B, sort bool) {
+	client := &Client{}
+	client.SetSortResults(sort)
+
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		envelope := makeLargeEnvelope(100000)
+		b.StartTimer()
+
+		if _, err := unwrap(client, envelope); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkUnwrapSorted(b *testing.B) {
+	benchmarkUnwrap(b, true)
+}
+
+func BenchmarkUnwrapUnsorted(b *testing.B) {
+	benchmarkUnwrap(b, false)
+}
+
+func TestReplicateChecksumsAgree(t *testing.T) {
+	checksum := "1181c1834012245d785120e3505ed169"
+	other := "0cc175b9c0f1b6a831c399e269772661"
+
+	agree := []Replicate{
+		{Resource: "unixfs1", Checksum: checksum, Number: 0, Valid: true},
+		{Resource: "unixfs2", Checksum: checksum, Number: 1, Valid: true},
+	}
+	assert.True(t, replicateChecksumsAgree(agree))
+
+	diverge := []Replicate{
+		{Resource: "unixfs1", Checksum: checksum, Number: 0, Valid: true},
+		{Resource: "unixfs2", Checksum: other, Number: 1, Valid: true},
+	}
+	assert.False(t, replicateChecksumsAgree(diverge))
+
+	stale := []Replicate{
+		{Resource: "unixfs1", Checksum: checksum, Number: 0, Valid: true},
+		{Resource: "unixfs2", Checksum: other, Number: 1, Valid: false},
+		{Resource: "unixfs3", Number: 2, Valid: false},
+	}
+	assert.True(t, replicateChecksumsAgree(stale))
+
+	missing := []Replicate{
+		{Resource: "unixfs1", Checksum: checksum, Number: 0, Valid: true},
+		{Resource: "unixfs2", Number: 1, Valid: true},
+	}
+	assert.False(t, replicateChecksumsAgree(missing))
+
+	assert.True(t, replicateChecksumsAgree(nil))
+}
+
+func TestReplicaChecksumsAgree(t *testing.T) {
+	response := func(checksum0, checksum1 string) string {
+		return `{"operation":"list","arguments":{},` +
+			`"target":{"collection":"/testZone","data_object":"x"},` +
+			`"result":{"single":{"collection":"/testZone","data_object":"x",` +
+			`"checksum":"1181c1834012245d785120e3505ed169","replicates":[` +
+			`{"checksum":"` + checksum0 + `","location":"localhost",` +
+			`"resource":"unixfs1","number":0,"valid":true},` +
+			`{"checksum":"` + checksum1 + `","location":"localhost",` +
+			`"resource":"unixfs2","number":1,"valid":true}]}}}`
+	}
+	checksum := "1181c1834012245d785120e3505ed169"
+	other := "0cc175b9c0f1b6a831c399e269772661"
+
+	client := newRespondingClient(response(checksum, checksum),
+		response(checksum, other), response(checksum, ""))
+	obj := NewDataObject(client, "/testZone/x")
+
+	agree, err := obj.ReplicaChecksumsAgree()
+	assert.NoError(t, err)
+	assert.True(t, agree)
+	assert.Equal(t, Args{Checksum: true, Replicate: true}, sentArgs(t, client))
+	assert.Equal(t, checksum, obj.IChecksum)
+	assert.Len(t, obj.Replicates(), 2)
+
+	agree, err = obj.ReplicaChecksumsAgree()
+	assert.NoError(t, err)
+	assert.False(t, agree)
+
+	agree, err = obj.ReplicaChecksumsAgree()
+	assert.NoError(t, err)
+	assert.False(t, agree)
+}
+
+func TestVerifyObjectChecksum(t *testing.T) {
+	response := func(op string, checksum string) string {
+		return `{"operation":"` + op + `","arguments":{},` +
+			`"target":{"collection":"/testZone","data_object":"x"},` +
+			`"result":{"single":{"collection":"/testZone","data_object":"x",` +
+			`"checksum":"` + checksum + `"}}}`
+	}
+	checksum := "1181c1834012245d785120e3505ed169"
+	other := "0cc175b9c0f1b6a831c399e269772661"
+	item := RodsItem{IPath: "/testZone", IName: "x"}
+
+	client := newRespondingClient(response(LIST, checksum),
+		response(CHECKSUM, checksum))
+	match, stored, recomputed, err := client.VerifyObjectChecksum(item)
+	assert.NoError(t, err)
+	assert.True(t, match)
+	assert.Equal(t, checksum, stored)
+	assert.Equal(t, checksum, recomputed)
+
+	// The stored checksum is replaced by recomputing, so a mismatch error
+	// records both
+	client = newRespondingClient(response(LIST, checksum),
+		response(CHECKSUM, other))
+	match, stored, recomputed, err = client.VerifyObjectChecksum(item)
+	assert.False(t, match)
+	assert.Equal(t, checksum, stored)
+	assert.Equal(t, other, recomputed)
+	if assert.Error(t, err) {
+		assert.Regexp(t, "^checksum mismatch for /testZone/x", err.Error())
+		assert.Contains(t, err.Error(), checksum)
+		assert.Contains(t, err.Error(), other)
+	}
+}
+
+func TestNoClient(t *testing.T) {
+	var item RodsItem
+	err := json.Unmarshal([]byte(`{"collection":"/testZone","data_object":"x"}`),
+		&item)
+	assert.NoError(t, err)
+
+	msg := "list operation on '/testZone/x' failed: item has no associated client"
+
+	_, err = item.Exists()
+	assert.EqualError(t, err, msg)
+	_, err = item.FetchMetadata()
+	assert.EqualError(t, err, msg)
+
+	coll := Collection{&RodsItem{IPath: "/testZone"}}
+	_, err = coll.FetchContentsRecurse()
+	assert.EqualError(t, err,
+		"list operation on '/testZone' failed: item has no associated client")
+}
+
+func TestClassifyExists(t *testing.T) {
+	rodsErr := func(code int32) error {
+		return errors.Wrap(&RodsError{errors.New("test"), code},
+			"list operation failed")
+	}
+
+	exists, accessible, err := classifyExists(nil)
+	assert.NoError(t, err)
+	assert.True(t, exists)
+	assert.True(t, accessible)
+
+	exists, accessible, err = classifyExists(rodsErr(RodsUserFileDoesNotExist))
+	assert.NoError(t, err)
+	assert.False(t, exists)
+	assert.False(t, accessible)
+
+	exists, accessible, err = classifyExists(rodsErr(RodsCatNoAccessPermission))
+	assert.NoError(t, err)
+	assert.True(t, exists)
+	assert.False(t, accessible)
+
+	_, _, err = classifyExists(rodsErr(RodsUnixFileReadError))
+	assert.True(t, IsRodsError(err))
+
+	_, _, err = classifyExists(errors.New("client is not running"))
+	assert.EqualError(t, err, "client is not running")
+}
+
+func TestRodsItem_Validate(t *testing.T) {
+	coll := RodsItem{IPath: "/testZone/a"}
+	obj := RodsItem{IPath: "/testZone/a", IName: "b"}
+	local := RodsItem{IDirectory: "/tmp", IFile: "b"}
+	put := RodsItem{IDirectory: "/tmp", IFile: "b", IPath: "/testZone/a"}
+
+	for _, op := range []string{CHMOD, LIST, METAMOD, MOVE} {
+		assert.NoError(t, coll.Validate(op), op)
+		assert.NoError(t, obj.Validate(op), op)
+		assert.EqualError(t, local.Validate(op),
+			op+" target must set IPath: "+fmt.Sprintf("%+v", &local), op)
+	}
+
+	for _, op := range []string{CHECKSUM, GET, REMOVE} {
+		assert.NoError(t, obj.Validate(op), op)
+		assert.ErrorContains(t, coll.Validate(op), "must set IName", op)
+	}
+
+	for _, op := range []string{MKDIR, RMDIR} {
+		assert.NoError(t, coll.Validate(op), op)
+		assert.ErrorContains(t, obj.Validate(op), "must not set IName", op)
+	}
+
+	assert.NoError(t, put.Validate(PUT))
+	assert.ErrorContains(t, obj.Validate(PUT), "must set IDirectory or IFile")
+
+	assert.NoError(t, coll.Validate(METAQUERY))
+	query := RodsItem{IAVUs: []AVU{{Attr: "a", Value: "b"}}}
+	assert.NoError(t, query.Validate(METAQUERY))
+	assert.ErrorContains(t, put.Validate(METAQUERY),
+		"metaquery target must not set IFile")
+	dir := RodsItem{IDirectory: "/tmp"}
+	assert.ErrorContains(t, dir.Validate(METAQUERY),
+		"metaquery target must not set IDirectory")
+
+	assert.EqualError(t, coll.Validate("invalid"), "invalid operation 'invalid'")
+}
+
+func TestACLsApplied(t *testing.T) {
+	read := ACL{Owner: "public", Level: "read", Zone: "testZone"}
+	own := ACL{Owner: "irods", Level: "own", Zone: "testZone"}
+
+	assert.True(t, aclsApplied([]ACL{own, read}, []ACL{read}))
+	assert.True(t, aclsApplied([]ACL{own, read},
+		[]ACL{{Owner: "public", Level: "read"}}))
+	assert.False(t, aclsApplied([]ACL{own}, []ACL{read}))
+	assert.False(t, aclsApplied([]ACL{own,
+		{Owner: "public", Level: "write", Zone: "testZone"}}, []ACL{read}))
+
+	assert.True(t, aclsApplied([]ACL{own},
+		[]ACL{{Owner: "public", Level: "null", Zone: "testZone"}}))
+	assert.False(t, aclsApplied([]ACL{own, read},
+		[]ACL{{Owner: "public", Level: "null", Zone: "testZone"}}))
+
+	assert.True(t, aclsApplied([]ACL{own}, []ACL{{Level: ACLInherit}}))
+}
+
+func TestIsPathUnder(t *testing.T) {
+	assert.True(t, isPathUnder("/testZone/a", "/testZone/a"))
+	assert.True(t, isPathUnder("/testZone/a", "/testZone/a/b/c"))
+	assert.False(t, isPathUnder("/testZone/a", "/testZone/ab"))
+	assert.False(t, isPathUnder("/testZone/a", "/testZone"))
+	assert.True(t, isPathUnder("/", "/testZone"))
+}
+
+func TestRelativeRodsPath(t *testing.T) {
+	for _, c := range []struct{ base, target, rel string }{
+		{"/testZone/a", "/testZone/a", "."},
+		{"/testZone/a", "/testZone/a/b/c", "b/c"},
+		{"/testZone/a/", "/testZone/a/b/c/", "b/c"},
+		{"/testZone/a/b", "/testZone/a/c", "../c"},
+		{"/testZone/a/b/c", "/testZone/a/d/e", "../../d/e"},
+		{"/testZone/a/b", "/testZone", "../.."},
+		{"/testZone/a", "/testZone/ab", "../ab"},
+		{"/", "/testZone/a", "testZone/a"},
+	} {
+		rel, err := RelativeRodsPath(c.base, c.target)
+		if assert.NoError(t, err) {
+			assert.Equal(t, c.rel, rel, "%s relative to %s", c.target, c.base)
+		}
+	}
+
+	_, err := RelativeRodsPath("testZone/a", "/testZone/a/b")
+	assert.Error(t, err)
+	_, err = RelativeRodsPath("/testZone/a", "b")
+	assert.Error(t, err)
+}
+
+func TestTruncatedResponse(t *testing.T) {
+	// A sub-process that exits after writing part of a response, without a
+	// final newline
+	client, err := NewClient("sh")
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = client.Start("-c",
+		`read -r request; printf '{"operation":"list","arguments":{},"res'`)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer client.StopIgnoreError()
+
+	_, err = client.send(wrap(LIST, Args{}, RodsItem{IPath: "/testZone"}))
+	if assert.Error(t, err) {
+		assert.Regexp(t, "^baton-do terminated unexpectedly", err.Error())
+		assert.True(t, IsProtocolError(err))
+	}
+}
+
+func TestProtocolError(t *testing.T) {
+	// A running client whose sub-process writes malformed JSON
+	client := &Client{
+		in:           make(chan []byte, 1),
+		out:          make(chan []byte, 1),
+		written:      make(chan error, 1),
+		writeTimeout: time.Second,
+		respTimeout:  time.Millisecond * 50,
+		isRunning:    true,
+	}
+	client.written <- nil
+	client.out <- []byte(`{"operation":"list",}`)
+
+	_, err := client.send(wrap(LIST, Args{}, RodsItem{IPath: "/testZone"}))
+	if assert.Error(t, err) {
+		assert.True(t, IsProtocolError(err))
+		assert.False(t, IsRodsError(err))
+		assert.Regexp(t, "^invalid JSON response from baton-do", err.Error())
+
+		var syntaxErr *json.SyntaxError
+		assert.ErrorAs(t, err, &syntaxErr)
+	}
+
+	_, err = unwrap(client, &Envelope{Operation: LIST})
+	if assert.Error(t, err) {
+		assert.True(t, IsProtocolError(err))
+		assert.EqualError(t, err, "invalid list operation envelope (no result)")
+	}
+
+	_, err = unwrap(client, &Envelope{Operation: LIST, Result: &ResultWrapper{}})
+	if assert.Error(t, err) {
+		assert.True(t, IsProtocolError(err))
+		assert.EqualError(t, err, "invalid list operation result (no content)")
+	}
+
+	_, err = unwrap(client, &Envelope{Operation: LIST,
+		ErrorMsg: &ErrorMsg{Message: "no such item", Code: -310000}})
+	if assert.Error(t, err) {
+		assert.False(t, IsProtocolError(err))
+		assert.True(t, IsRodsError(err))
+	}
+}
+
+// newRespondingClient returns a running client whose sub-process responds to
+// each request with the next of the responses, in order. The requests sent
+// may be read from the client's in channel.
+func newRespondingClient(responses ...string) *Client {
+	n := len(responses)
+	client := &Client{
+		in:           make(chan []byte, n),
+		out:          make(chan []byte, n),
+		written:      make(chan error, n),
+		writeTimeout: time.Second,
+		respTimeout:  time.Second,
+		isRunning:    true,
+	}
+	for _, response := range responses {
+		client.written <- nil
+		client.out <- []byte(response)
+	}
+
+	return client
+}
+
+// newEchoingClient returns a running client whose sub-process responds to each
+// request with its target, after calling onRequest with the request. The
+// response may be changed by modifying the request, e.g. its target or error.
+func newEchoingClient(t *testing.T, onRequest func(request *Envelope)) *Client {
+	client := &Client{
+		in:           make(chan []byte),
+		out:          make(chan []byte),
+		written:      make(chan error),
+		writeTimeout: time.Second,
+		respTimeout:  time.Second,
+		isRunning:    true,
+	}
+
+	stop := make(chan struct{})
+	t.Cleanup(func() { close(stop) })
+
+	go func() {
+		for {
+			var message []byte
+			select {
+			case <-stop:
+				return
+			case message = <-client.in:
+			}
+			client.written <- nil
+
+			request := &Envelope{}
+			assert.NoError(t, json.Unmarshal(message, request))
+			onRequest(request)
+
+			target := request.Target
+			request.Result = &ResultWrapper{Item: &target}
+			response, err := json.Marshal(request)
+			assert.NoError(t, err)
+			client.out <- response
+		}
+	}()
+
+	return client
+}
+
+// sentArgs returns the arguments of the next request sent by the client.
+func sentArgs(t *testing.T, client *Client) Args {
+	envelope := &Envelope{}
+	err := json.Unmarshal(<-client.in, envelope)
+	assert.NoError(t, err)
+	return envelope.Arguments
+}
+
+const listObjResponse = `{"operation":"list","arguments":{},` +
+	`"target":{"collection":"/testZone","data_object":"x"},` +
+	`"result":{"single":{"collection":"/testZone","data_object":"x",` +
+	`"checksum":"1181c1834012245d785120e3505ed169",` +
+	`"avus":[{"attribute":"a","value":"b"}]}}}`
+
+func TestRefresh(t *testing.T) {
+	client := newRespondingClient(listObjResponse, listObjResponse,
+		listObjResponse)
+
+	obj := NewDataObject(client, "/testZone/x")
+	_, err := obj.FetchMetadata()
+	assert.NoError(t, err)
+	assert.Equal(t, Args{AVU: true}, sentArgs(t, client))
+
+	_, err = obj.FetchTimestamps()
+	assert.NoError(t, err)
+	assert.Equal(t, Args{Timestamp: true}, sentArgs(t, client))
+
+	// Only the metadata and timestamps are re-requested and replaced
+	obj.IAVUs = nil
+	err = obj.Refresh()
+	assert.NoError(t, err)
+	assert.Equal(t, Args{AVU: true, Timestamp: true}, sentArgs(t, client))
+	assert.Equal(t, []AVU{{Attr: "a", Value: "b"}}, obj.Metadata())
+	assert.Empty(t, obj.Checksum())
+}
+
+func TestContentsStale(t *testing.T) {
+	listCollResponse := `{"operation":"list","arguments":{"contents":true},` +
+		`"target":{"collection":"/testZone"},` +
+		`"result":{"single":{"collection":"/testZone",` +
+		`"contents":[{"collection":"/testZone","data_object":"x"}]}}}`
+	putResponse := `{"operation":"put","arguments":{},` +
+		`"target":{"collection":"/testZone","data_object":"y"},` +
+		`"result":{"single":{"collection":"/testZone","data_object":"y"}}}`
+
+	client := newRespondingClient(listCollResponse, putResponse,
+		listObjResponse, listCollResponse)
+
+	coll := NewCollection(client, "/testZone")
+	_, err := coll.FetchContents()
+	assert.NoError(t, err)
+	assert.False(t, coll.ContentsStale())
+
+	_, err = coll.PutObject("testdata/1/reads/fast5/reads1.fast5", "y")
+	assert.NoError(t, err)
+
+	// The cached contents are returned, but are marked stale
+	assert.True(t, coll.ContentsStale())
+	assert.Len(t, coll.Contents(), 1)
+
+	_, err = coll.FetchContents()
+	assert.NoError(t, err)
+	assert.False(t, coll.ContentsStale())
+}
+
+func TestItemFromPath(t *testing.T) {
+	client := newRespondingClient(listObjResponse)
+
+	item, err := client.ItemFromPath("/testZone/x/")
+	assert.NoError(t, err)
+	assert.Equal(t, Args{}, sentArgs(t, client))
+	assert.True(t, item.IsDataObject())
+	assert.Equal(t, "/testZone/x", item.RodsPath())
+	assert.Equal(t, client, item.client)
+}
+
+func TestDescribe(t *testing.T) {
+	const response = `{"operation":"list","arguments":{},` +
+		`"target":{"collection":"/testZone","data_object":"x"},` +
+		`"result":{"single":{"collection":"/testZone","data_object":"x",` +
+		`"checksum":"1181c1834012245d785120e3505ed169","size":15,` +
+		`"replicates":[{"checksum":"1181c1834012245d785120e3505ed169",` +
+		`"location":"localhost","resource":"demoResc","number":0,` +
+		`"valid":true}],` +
+		`"timestamps":[{"created":"2020-01-01T00:00:00Z",` +
+		`"modified":"2020-01-01T00:00:00Z","replicates":0}],` +
+		`"access":[{"owner":"irods","level":"own","zone":"testZone"}],` +
+		`"avus":[{"attribute":"a","value":"b"}]}}}`
+	client := newRespondingClient(response)
+
+	item, err := client.Describe(RodsItem{IPath: "/testZone", IName: "x"})
+	assert.NoError(t, err)
+	assert.Equal(t, Args{ACL: true, AVU: true, Checksum: true, Replicate: true,
+		Size: true, Timestamp: true}, sentArgs(t, client))
+	assert.Equal(t, client, item.client)
+	assert.Equal(t, "1181c1834012245d785120e3505ed169", item.IChecksum)
+	assert.Equal(t, uint64(15), item.ISize)
+	assert.Len(t, item.IReplicates, 1)
+	assert.Len(t, item.ITimestamps, 1)
+	assert.Len(t, item.IACLs, 1)
+	assert.Len(t, item.IAVUs, 1)
+}
+
+func TestListItemMultiple(t *testing.T) {
+	multipleResponse := `{"operation":"list","arguments":{},` +
+		`"target":{"collection":"/testZone","data_object":"x"},` +
+		`"result":{"multiple":[` +
+		`{"collection":"/testZone","data_object":"x"},` +
+		`{"collection":"/testZone","data_object":"x"}]}}`
+
+	// Multiple results for a single data object are a protocol error
+	client := newRespondingClient(multipleResponse)
+	_, err := client.ListItem(Args{}, RodsItem{IPath: "/testZone", IName: "x"})
+	assert.True(t, IsProtocolError(err))
+	assert.Contains(t, err.Error(), "2 items were returned for the single "+
+		"data object '/testZone/x'")
+
+	// For a collection, they are not
+	client = newRespondingClient(multipleResponse)
+	_, err = client.ListItem(Args{}, RodsItem{IPath: "/testZone"})
+	assert.Error(t, err)
+	assert.False(t, IsProtocolError(err))
+}
+
+func TestRemoveItem(t *testing.T) {
+	client := newRespondingClient(
+		`{"operation":"remove","arguments":{},`+
+			`"target":{"collection":"/testZone","data_object":"x"},`+
+			`"result":{"single":{"collection":"/testZone","data_object":"x"}}}`,
+		`{"operation":"rmdir","arguments":{},`+
+			`"target":{"collection":"/testZone/y"},`+
+			`"result":{"single":{"collection":"/testZone/y"}}}`)
+
+	sentOperation := func() string {
+		envelope := &Envelope{}
+		assert.NoError(t, json.Unmarshal(<-client.in, envelope))
+		return envelope.Operation
+	}
+
+	obj := RodsItem{client: client, IPath: "/testZone", IName: "x"}
+	assert.NoError(t, obj.Remove())
+	assert.Equal(t, REMOVE, sentOperation())
+
+	coll := RodsItem{client: client, IPath: "/testZone/y"}
+	assert.NoError(t, coll.Remove())
+	assert.Equal(t, RMDIR, sentOperation())
+
+	local := RodsItem{client: client, IDirectory: "testdata"}
+	assert.Error(t, local.Remove())
+}
+
+func TestBuildTree(t *testing.T) {
+	items := []RodsItem{
+		{IPath: "/testZone/a/c", IName: "y"},
+		{IPath: "/testZone/a/c"},
+		{IPath: "/testZone/a", IName: "x"},
+		{IPath: "/testZone/a/b"},
+		{IPath: "/testZone/a"},
+	}
+
+	root, err := buildTree(items)
+	assert.NoError(t, err)
+	assert.Equal(t, "/testZone/a", root.Collection.RodsPath())
+	assert.Equal(t, []RodsItem{{IPath: "/testZone/a", IName: "x"}},
+		root.DataObjects)
+
+	if assert.Len(t, root.Collections, 2) {
+		b, c := root.Collections[0], root.Collections[1]
+		assert.Equal(t, "/testZone/a/b", b.Collection.RodsPath())
+		assert.Empty(t, b.Collections)
+		assert.Empty(t, b.DataObjects)
+
+		assert.Equal(t, "/testZone/a/c", c.Collection.RodsPath())
+		assert.Equal(t, []RodsItem{{IPath: "/testZone/a/c", IName: "y"}},
+			c.DataObjects)
+	}
+
+	_, err = buildTree(nil)
+	assert.Error(t, err)
+
+	_, err = buildTree([]RodsItem{{IPath: "/testZone/a"}, {IPath: "/testZone/b"}})
+	assert.Error(t, err)
+}
+
+func TestSkipNonJSONOutput(t *testing.T) {
+	client := newRespondingClient("baton-do: a diagnostic message", "",
+		listObjResponse)
+
+	item, err := client.ListItem(Args{}, RodsItem{IPath: "/testZone", IName: "x"})
+	assert.NoError(t, err)
+	assert.Equal(t, "/testZone/x", item.RodsPath())
+	assert.Empty(t, client.out)
+
+	// A truncated JSON object is still an error
+	client = newRespondingClient(`{"operation":"list","arguments":{}`)
+	_, err = client.ListItem(Args{}, RodsItem{IPath: "/testZone", IName: "x"})
+	assert.True(t, IsProtocolError(err))
+}
+
+func TestPutContextCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Cancel once the first file is being put
+	client := newEchoingClient(t, func(request *Envelope) {
+		if request.Operation == PUT {
+			cancel()
+		}
+	})
+
+	items, err := client.PutContext(ctx, Args{Recurse: true},
+		RodsItem{IDirectory: "testdata/1/reads/fast5", IPath: "/testZone"})
+	assert.ErrorIs(t, err, context.Canceled)
+	if assert.Len(t, items, 1) {
+		assert.Equal(t, "/testZone/fast5/reads1.fast5", items[0].RodsPath())
+	}
+
+	// A put is not started once cancelled
+	items, err = client.PutContext(ctx, Args{},
+		RodsItem{IDirectory: "testdata/1/reads/fast5", IFile: "reads1.fast5",
+			IPath: "/testZone", IName: "reads1.fast5"})
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Empty(t, items)
+}
+
+func TestListTolerant(t *testing.T) {
+	client := newEchoingClient(t, func(request *Envelope) {
+		switch request.Target.RodsPath() {
+		case "/testZone/a":
+			request.Target.IContents = []RodsItem{
+				{IPath: "/testZone/a/b"},
+				{IPath: "/testZone/a/c"},
+				{IPath: "/testZone/a", IName: "x"},
+			}
+		case "/testZone/a/b":
+			request.ErrorMsg = &ErrorMsg{Message: "no access", Code: -818000}
+		case "/testZone/a/c":
+			request.Target.IContents = []RodsItem{
+				{IPath: "/testZone/a/c", IName: "y"},
+			}
+		}
+	})
+
+	items, failures, err := client.ListTolerant(Args{}, RodsItem{IPath: "/testZone/a"})
+	assert.NoError(t, err)
+
+	var paths []string
+	for _, item := range items {
+		paths = append(paths, item.RodsPath())
+	}
+	assert.Equal(t, []string{"/testZone/a", "/testZone/a/c", "/testZone/a/x",
+		"/testZone/a/c/y"}, paths)
+
+	if assert.Len(t, failures, 1) {
+		assert.Equal(t, "/testZone/a/b", failures[0].Path)
+		code, cerr := RodsErrorCode(failures[0].Err)
+		assert.NoError(t, cerr)
+		assert.Equal(t, RodsCatNoAccessPermission, code)
+	}
+
+	// Failure to list the item itself is an error
+	_, _, err = client.ListTolerant(Args{}, RodsItem{IPath: "/testZone/a/b"})
+	assert.Error(t, err)
+
+	// List, unlike ListTolerant, fails when a child collection cannot be
+	// listed
+	items, err = client.List(Args{Recurse: true}, RodsItem{IPath: "/testZone/a"})
+	assert.Empty(t, items)
+	if assert.Error(t, err) {
+		code, cerr := RodsErrorCode(err)
+		assert.NoError(t, cerr)
+		assert.Equal(t, RodsCatNoAccessPermission, code)
+	}
+}
+
+func TestLock(t *testing.T) {
+	// A sub-process holding metadata for a single data object
+	var stored []AVU
+	client := newEchoingClient(t, func(request *Envelope) {
+		switch request.Operation {
+		case LIST:
+			request.Target.IAVUs = append([]AVU{}, stored...)
+		case METAMOD:
+			if request.Arguments.Operation == METAADD {
+				stored = SetUnionAVUs(stored, request.Target.IAVUs)
+			} else {
+				stored = SetDiffAVUs(stored, request.Target.IAVUs)
+			}
+		}
+	})
+
+	obj := NewDataObject(client, "/testZone/x")
+	assert.NoError(t, obj.Lock(time.Hour))
+	assert.Len(t, stored, 1)
+
+	// A second lock fails until unlocked
+	err := obj.Lock(time.Hour)
+	assert.True(t, IsLocked(err))
+	assert.True(t, IsLocked(NewDataObject(client, "/testZone/x").Lock(time.Hour)))
+
+	assert.NoError(t, obj.Unlock())
+	assert.Empty(t, stored)
+	assert.NoError(t, obj.Lock(time.Hour))
+
+	// A lock held by another is not removed by Unlock, but is replaced once
+	// it has expired
+	other := AVU{Attr: LockAttr, Value: "otherhost:1 " +
+		time.Now().Add(-time.Second).UTC().Format(time.RFC3339Nano)}
+	stored = []AVU{other}
+	assert.NoError(t, obj.Unlock())
+	assert.Equal(t, []AVU{other}, stored)
+	assert.NoError(t, obj.Lock(time.Hour))
+	if assert.Len(t, stored, 1) {
+		assert.True(t, strings.HasPrefix(stored[0].Value, lockHolder+" "))
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	client := newRespondingClient(listObjResponse, listObjResponse,
+		listObjResponse)
+
+	for i := uint64(1); i <= 3; i++ {
+		_, err := client.ListItem(Args{}, RodsItem{IPath: "/testZone", IName: "x"})
+		assert.NoError(t, err)
+
+		envelope := &Envelope{}
+		assert.NoError(t, json.Unmarshal(<-client.in, envelope))
+		assert.Equal(t, i, envelope.ID)
+	}
+
+	// A response to a different request is a protocol error
+	client = newRespondingClient(`{"operation":"list","arguments":{},"id":2,` +
+		`"target":{"collection":"/testZone"},` +
+		`"result":{"single":{"collection":"/testZone"}}}`)
+	_, err := client.ListItem(Args{}, RodsItem{IPath: "/testZone"})
+	assert.True(t, IsProtocolError(err))
+}
+
+func TestSubOperation(t *testing.T) {
+	client := newRespondingClient(`{"operation":"metamod",` +
+		`"arguments":{"operation":"add"},` +
+		`"target":{"collection":"/testZone","avus":[{"attribute":"a","value":"b"}]},` +
+		`"result":{"single":{"collection":"/testZone"}}}`)
+
+	item := RodsItem{IPath: "/testZone", IAVUs: []AVU{{Attr: "a", Value: "b"}}}
+	_, err := client.MetaAdd(Args{}, item)
+	assert.NoError(t, err)
+
+	envelope := &Envelope{}
+	assert.NoError(t, json.Unmarshal(<-client.in, envelope))
+	assert.Equal(t, METAMOD, envelope.Operation)
+	assert.Equal(t, METAADD, envelope.Arguments.Operation)
+
+	_, err = client.List(Args{Operation: METAADD}, item)
+	assert.EqualError(t, err, "invalid argument: list operation does not "+
+		"permit a sub-operation, but 'add' was set")
+
+	_, err = client.metaMod(Args{}, item)
+	assert.EqualError(t, err, "invalid metamod sub-operation ''")
+}
+
+func TestChecksumCached(t *testing.T) {
+	client := newRespondingClient(listObjResponse)
+
+	// Checksum returns only the cached checksum, without fetching it
+	obj := NewDataObject(client, "/testZone/x")
+	assert.Empty(t, obj.Checksum())
+	assert.Empty(t, client.in)
+
+	checksum, err := obj.FetchChecksum()
+	assert.NoError(t, err)
+	assert.Equal(t, "1181c1834012245d785120e3505ed169", checksum)
+	assert.Equal(t, Args{Checksum: true}, sentArgs(t, client))
+	assert.Equal(t, checksum, obj.Checksum())
+
+	// A failure to fetch is returned
+	obj = NewDataObject(nil, "/testZone/x")
+	_, err = obj.FetchChecksum()
+	assert.Error(t, err)
+}
+
+func TestChecksumOrFetch(t *testing.T) {
+	client := newRespondingClient(listObjResponse)
+
+	// An empty cache is filled by fetching
+	obj := NewDataObject(client, "/testZone/x")
+	checksum, err := obj.ChecksumOrFetch()
+	assert.NoError(t, err)
+	assert.Equal(t, "1181c1834012245d785120e3505ed169", checksum)
+	assert.Equal(t, Args{Checksum: true}, sentArgs(t, client))
+	assert.Equal(t, checksum, obj.Checksum())
+
+	// A cached checksum is returned without fetching
+	checksum, err = obj.ChecksumOrFetch()
+	assert.NoError(t, err)
+	assert.Equal(t, "1181c1834012245d785120e3505ed169", checksum)
+	assert.Empty(t, client.in)
+
+	// A failure to fetch is returned
+	obj = NewDataObject(nil, "/testZone/x")
+	_, err = obj.ChecksumOrFetch()
+	assert.Error(t, err)
+}
+
+func TestPutVerified(t *testing.T) {
+	localPath := "testdata/1/reads/fast5/reads1.fast5"
+	remotePath := "/testZone/reads1.fast5"
+	good := "1181c1834012245d785120e3505ed169"
+	bad := "0cc175b9c0f1b6a831c399e269772661"
+	mismatch := &RodsError{errors.New("put failed"), RodsUserChecksumMismatch}
+
+	// Each put returns the next checksum, or an error if there is none
+	var tries int
+	putReturning := func(results ...interface{}) func() (*DataObject, error) {
+		tries = 0
+		return func() (*DataObject, error) {
+			result := results[tries]
+			tries++
+			if err, ok := result.(error); ok {
+				return nil, err
+			}
+			obj := NewDataObject(nil, remotePath)
+			obj.IChecksum = result.(string)
+			return obj, nil
+		}
+	}
+
+	// A mismatch is retried and a subsequent match succeeds
+	obj, err := putVerified(putReturning(bad, good), localPath, remotePath, 3)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, tries)
+	assert.Equal(t, good, obj.Checksum())
+
+	// A mismatch reported by iRODS during the put is retried
+	obj, err = putVerified(putReturning(mismatch, good), localPath,
+		remotePath, 3)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, tries)
+	assert.Equal(t, good, obj.Checksum())
+
+	// Repeated mismatches fail after maxTries
+	_, err = putVerified(putReturning(bad, mismatch, good), localPath,
+		remotePath, 2)
+	if assert.Error(t, err) {
+		assert.Regexp(t, "^failed to put .* after 2 tries", err.Error())
+		code, cerr := RodsErrorCode(err)
+		assert.NoError(t, cerr)
+		assert.Equal(t, RodsUserChecksumMismatch, code)
+	}
+	assert.Equal(t, 2, tries)
+
+	// A failed put is not retried
+	_, err = putVerified(putReturning(errors.New("put failed"), good),
+		localPath, remotePath, 3)
+	assert.EqualError(t, err, "put failed")
+	assert.Equal(t, 1, tries)
+
+	// A checksum that is not MD5 cannot be compared and is not retried
+	_, err = putVerified(putReturning("sha2:"+strings.Repeat("A", 43)+"=",
+		good), localPath, remotePath, 3)
+	if assert.Error(t, err) {
+		assert.Regexp(t, "is not an MD5 checksum", err.Error())
+	}
+	assert.Equal(t, 1, tries)
+
+	_, err = putVerified(putReturning(good), localPath, remotePath, 0)
+	assert.Error(t, err)
+}
+
+func TestCollectionModifiedTime(t *testing.T) {
+	const response = `{"operation":"list","arguments":{},` +
+		`"target":{"collection":"/testZone/x"},` +
+		`"result":{"single":{"collection":"/testZone/x","contents":[` +
+		`{"collection":"/testZone/x","data_object":"a","timestamps":[` +
+		`{"modified":"2020-01-01T00:00:00Z","replicates":0},` +
+		`{"modified":"2020-03-01T00:00:00Z","replicates":1}]},` +
+		`{"collection":"/testZone/x","data_object":"b","timestamps":[` +
+		`{"modified":"2020-02-01T00:00:00Z","replicates":0}]},` +
+		`{"collection":"/testZone/x/y"}]}}}`
+	const empty = `{"operation":"list","arguments":{},` +
+		`"target":{"collection":"/testZone/x"},` +
+		`"result":{"single":{"collection":"/testZone/x","contents":[]}}}`
+
+	client := newRespondingClient(response, empty)
+	coll := NewCollection(client, "/testZone/x")
+
+	modified, err := coll.ModifiedTime()
+	assert.NoError(t, err)
+	assert.Equal(t, time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC), modified.UTC())
+	assert.Empty(t, coll.Contents())
+
+	_, err = coll.ModifiedTime()
+	assert.Error(t, err)
+}
+
+func TestBuildEnvelope(t *testing.T) {
+	data, err := BuildEnvelope(LIST, Args{AVU: true, Contents: true},
+		RodsItem{IPath: "/testZone", IName: "x"})
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"operation":"list",`+
+		`"arguments":{"avu":true,"contents":true},`+
+		`"target":{"collection":"/testZone","data_object":"x"}}`, string(data))
+
+	data, err = BuildEnvelope(METAQUERY, Args{Object: true},
+		RodsItem{IPath: "/testZone",
+			IAVUs: []AVU{{Attr: "a", Value: "1", Operator: "="}}})
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"operation":"metaquery",`+
+		`"arguments":{"object":true},`+
+		`"target":{"collection":"/testZone",`+
+		`"avus":[{"attribute":"a","value":"1","operator":"="}]}}`, string(data))
+
+	_, err = BuildEnvelope(LIST, Args{Operation: METAADD},
+		RodsItem{IPath: "/testZone"})
+	assert.Error(t, err)
+}
+
+func TestParseEnvelope(t *testing.T) {
+	items, err := ParseEnvelope([]byte(listObjResponse))
+	if assert.NoError(t, err) && assert.Len(t, items, 1) {
+		assert.Equal(t, "/testZone/x", items[0].RodsPath())
+		assert.Nil(t, items[0].client)
+	}
+
+	multiple := `{"operation":"metaquery","arguments":{},` +
+		`"target":{"collection":"/testZone","avus":[]},` +
+		`"result":{"multiple":[` +
+		`{"collection":"/testZone","data_object":"b"},` +
+		`{"collection":"/testZone","data_object":"a"}]}}`
+	items, err = ParseEnvelope([]byte(multiple))
+	if assert.NoError(t, err) && assert.Len(t, items, 2) {
+		assert.Equal(t, "/testZone/a", items[0].RodsPath())
+		assert.Equal(t, "/testZone/b", items[1].RodsPath())
+	}
+
+	failed := `{"operation":"list","arguments":{},` +
+		`"target":{"collection":"/testZone","data_object":"x"},` +
+		`"error":{"message":"Path '/testZone/x' does not exist",` +
+		`"code":-310000}}`
+	_, err = ParseEnvelope([]byte(failed))
+	assert.True(t, IsRodsError(err))
+	code, _ := RodsErrorCode(err)
+	assert.Equal(t, RodsUserFileDoesNotExist, code)
+
+	noResult := `{"operation":"list","arguments":{},` +
+		`"target":{"collection":"/testZone","data_object":"x"}}`
+	_, err = ParseEnvelope([]byte(noResult))
+	assert.True(t, IsProtocolError(err))
+
+	_, err = ParseEnvelope([]byte(`{"operation":"list",`))
+	assert.True(t, IsProtocolError(err))
+}
+
+func TestPutDirectory(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "data")
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, "sub"), 0755))
+	for _, name := range []string{"a.txt", "b.txt", "sub/c.txt"} {
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, name),
+			[]byte(name), 0644))
+	}
+
+	var mkdirs, puts []string
+	client := newEchoingClient(t, func(request *Envelope) {
+		switch request.Operation {
+		case MKDIR:
+			mkdirs = append(mkdirs, request.Target.RodsPath())
+		case PUT:
+			puts = append(puts, request.Target.RodsPath())
+			if request.Target.IName == "a.txt" {
+				request.ErrorMsg = &ErrorMsg{Message: "put failed", Code: -1}
+			}
+		}
+	})
+
+	var progress []int
+	coll := NewCollection(client, "/testZone/x")
+	_, err := coll.PutDirectory(dir, PutDirectoryOpts{
+		Progress: func(obj RodsItem, done int, total int) {
+			assert.Equal(t, 3, total)
+			progress = append(progress, done)
+		}})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "failed to put 1 of 3 items")
+	}
+
+	assert.Equal(t, []string{"/testZone/x/data", "/testZone/x/data/sub"}, mkdirs)
+	assert.Equal(t, []string{"/testZone/x/data/a.txt",
+		"/testZone/x/data/b.txt", "/testZone/x/data/sub/c.txt"}, puts)
+	assert.Equal(t, []int{1, 2}, progress)
+}
+
+func TestWorkingCollectionLeavesZone(t *testing.T) {
+	var sent []Envelope
+	client := newEchoingClient(t, func(request *Envelope) {
+		sent = append(sent, *request)
+	})
+	assert.NoError(t, client.SetWorkingCollection("/testZone/home/irods"))
+
+	// Relative paths within the zone are joined and cleaned
+	_, err := client.ListItem(Args{}, RodsItem{IPath: "../x"})
+	assert.NoError(t, err)
+	_, err = client.Move(Args{Path: "../../y"},
+		RodsItem{IPath: "/testZone/home/irods", IName: "z"})
+	assert.NoError(t, err)
+	if assert.Len(t, sent, 2) {
+		assert.Equal(t, "/testZone/home/x", sent[0].Target.IPath)
+		assert.Equal(t, "/testZone/y", sent[1].Arguments.Path)
+	}
+
+	// Those leaving the zone are rejected, rather than sent cleaned into
+	// another zone
+	sent = nil
+	_, err = client.ListItem(Args{}, RodsItem{IPath: "../../../otherZone/x"})
+	if assert.Error(t, err) {
+		assert.Regexp(t, "relative path '../../../otherZone/x' leaves the "+
+			"zone of the working collection '/testZone/home/irods'", err.Error())
+	}
+
+	_, err = client.Move(Args{Path: "../../../otherZone/y"},
+		RodsItem{IPath: "/testZone/home/irods", IName: "z"})
+	if assert.Error(t, err) {
+		assert.Regexp(t, "relative path '../../../otherZone/y' leaves the "+
+			"zone of the working collection '/testZone/home/irods'", err.Error())
+	}
+	assert.Empty(t, sent)
+}
+
+func TestNormaliseUnicode(t *testing.T) {
+	const nfc = "caf\u00e9"  // Composed
+	const nfd = "cafe\u0301" // Decomposed
+	assert.NotEqual(t, nfc, nfd)
+
+	var sent RodsItem
+	client := newEchoingClient(t, func(request *Envelope) {
+		sent = request.Target
+	})
+
+	avus := []AVU{{Attr: nfd, Value: nfd, Units: nfd}}
+	item := RodsItem{IPath: "/testZone/" + nfd, IName: nfd, IAVUs: avus}
+
+	_, err := client.MetaQuery(Args{Object: true}, item)
+	assert.NoError(t, err)
+	assert.Equal(t, "/testZone/"+nfd, sent.IPath)
+	assert.Equal(t, nfd, sent.IAVUs[0].Value)
+
+	client.SetNormaliseUnicode(true)
+	assert.True(t, client.NormaliseUnicode())
+
+	_, err = client.MetaQuery(Args{Object: true}, item)
+	assert.NoError(t, err)
+	assert.Equal(t, "/testZone/"+nfc, sent.IPath)
+	assert.Equal(t, nfc, sent.IName)
+	assert.Equal(t, AVU{Attr: nfc, Value: nfc, Units: nfc}, sent.IAVUs[0])
+
+	// The caller's AVUs are not modified
+	assert.Equal(t, nfd, avus[0].Value)
+}
+
+func TestNormaliseUnicodeClientSide(t *testing.T) {
+	const nfc = "caf\u00e9"  // Composed
+	const nfd = "cafe\u0301" // Decomposed
+
+	// A sub-process holding NFC names and metadata, as it would after they
+	// were sent normalised
+	stored := []AVU{{Attr: "a", Value: nfc, Units: nfc}}
+	var sent []RodsItem
+	client := newEchoingClient(t, func(request *Envelope) {
+		sent = append(sent, request.Target)
+		switch request.Operation {
+		case METAQUERY:
+			request.Target = RodsItem{IPath: "/testZone/" + nfc, IName: "x",
+				IAVUs: stored}
+		case LIST:
+			request.Target.IAVUs = append([]AVU{}, stored...)
+		case METAMOD:
+			if request.Arguments.Operation == METAADD {
+				stored = SetUnionAVUs(stored, request.Target.IAVUs)
+			} else {
+				stored = SetDiffAVUs(stored, request.Target.IAVUs)
+			}
+		}
+	})
+	client.SetNormaliseUnicode(true)
+	query := RodsItem{IAVUs: []AVU{{Attr: "a", Value: nfd, Units: nfd}}}
+
+	// Query units are compared after normalisation
+	items, err := client.MetaQuery(Args{Object: true, MatchUnits: true}, query)
+	assert.NoError(t, err)
+	assert.Len(t, items, 1)
+
+	// The collection is compared after normalisation
+	items, err = client.MetaQueryUnder("/testZone/"+nfd, Args{Object: true},
+		query)
+	assert.NoError(t, err)
+	assert.Len(t, items, 1)
+
+	// AVUs are compared with the current AVUs after normalisation, so an
+	// existing AVU is neither removed nor added again
+	sent = nil
+	obj := NewDataObject(client, "/testZone/"+nfc+"/x")
+	assert.NoError(t, obj.ReplaceMetadata([]AVU{{Attr: "a", Value: nfd,
+		Units: nfd}}))
+	assert.Len(t, sent, 1) // Only the list of the current AVUs
+	assert.Equal(t, []AVU{{Attr: "a", Value: nfc, Units: nfc}}, obj.Metadata())
+	assert.True(t, obj.HasMetadatum(AVU{Attr: "a", Value: nfd, Units: nfd}))
+
+	toAdd, toRemove, err := CompareMetadata(*obj.RodsItem,
+		[]AVU{{Attr: "a", Value: nfd, Units: nfd}})
+	assert.NoError(t, err)
+	assert.Empty(t, toAdd)
+	assert.Empty(t, toRemove)
+
+	// The working collection is normalised
+	assert.NoError(t, client.SetWorkingCollection("/testZone/"+nfd))
+	sent = nil
+	_, err = client.ListItem(Args{}, RodsItem{IPath: "sub"})
+	assert.NoError(t, err)
+	if assert.Len(t, sent, 1) {
+		assert.Equal(t, "/testZone/"+nfc+"/sub", sent[0].IPath)
+	}
+}
+
+func TestLastActivity(t *testing.T) {
+	client := newEchoingClient(t, func(request *Envelope) {})
+	assert.True(t, client.LastActivity().IsZero())
+
+	before := time.Now()
+	_, err := client.ListItem(Args{}, RodsItem{IPath: "/testZone"})
+	assert.NoError(t, err)
+
+	last := client.LastActivity()
+	assert.False(t, last.Before(before))
+	assert.False(t, last.After(time.Now()))
+}
+
+func TestReplaceMetadataOrdered(t *testing.T) {
+	// A sub-process holding metadata for a single data object, in the order
+	// added
+	stored := []AVU{{Attr: "other", Value: "1"}, {Attr: "tag", Value: "b"}}
+	client := newEchoingClient(t, func(request *Envelope) {
+		switch request.Operation {
+		case LIST:
+			request.Target.IAVUs = append([]AVU{}, stored...)
+		case METAMOD:
+			if request.Arguments.Operation == METAADD {
+				stored = append(stored, request.Target.IAVUs...)
+			} else {
+				stored = SetDiffAVUs(stored, request.Target.IAVUs)
+			}
+		}
+	})
+	client.SetSortResults(false)
+
+	tags := []AVU{{Attr: "tag", Value: "c"}, {Attr: "tag", Value: "a"},
+		{Attr: "tag", Value: "b"}, {Attr: "tag", Value: "a"}}
+	expected := []AVU{{Attr: "other", Value: "1"}, {Attr: "tag", Value: "c"},
+		{Attr: "tag", Value: "a"}, {Attr: "tag", Value: "b"}}
+
+	obj := NewDataObject(client, "/testZone/x")
+	assert.NoError(t, obj.ReplaceMetadataOrdered(tags))
+	assert.Equal(t, expected, obj.Metadata())
+	assert.Equal(t, expected, stored)
+
+	// ReplaceMetadata sorts
+	assert.NoError(t, obj.ReplaceMetadata(tags))
+	assert.Equal(t, []AVU{{Attr: "other", Value: "1"}, {Attr: "tag", Value: "a"},
+		{Attr: "tag", Value: "b"}, {Attr: "tag", Value: "c"}}, obj.Metadata())
+}
+
+func TestClientPoolParamsValidate(t *testing.T) {
+	assert.NoError(t, DefaultClientPoolParams.Validate())
+
+	params := DefaultClientPoolParams
+	params.MaxSize = 0
+	assert.Error(t, params.Validate())
+
+	params = DefaultClientPoolParams
+	params.GetMaxRetries = 0 // A single try
+	assert.NoError(t, params.Validate())
+
+	params = DefaultClientPoolParams
+	params.CheckClientFreq = 0
+	assert.Error(t, params.Validate())
+
+	params = DefaultClientPoolParams
+	params.MinIdle = params.MaxSize + 1
+	assert.Error(t, params.Validate())
+
+	params = DefaultClientPoolParams
+	params.GetTimeout = 0
+	assert.Error(t, params.Validate())
+
+	for _, d := range []time.Duration{0, -time.Second} {
+		params = DefaultClientPoolParams
+		params.MaxClientRuntime = d
+		assert.EqualError(t, params.Validate(), "invalid client pool "+
+			"parameters: MaxClientRuntime must be > 0")
+
+		params = DefaultClientPoolParams
+		params.MaxClientIdleTime = d
+		assert.EqualError(t, params.Validate(), "invalid client pool "+
+			"parameters: MaxClientIdleTime must be > 0")
+	}
+}
+
+func TestNewClientPoolChecked(t *testing.T) {
+	params := DefaultClientPoolParams
+	params.MaxClientIdleTime = 0
+	pool, err := NewClientPoolChecked(params)
+	assert.Error(t, err)
+	assert.Nil(t, pool)
+
+	pool, err = NewClientPoolChecked(DefaultClientPoolParams)
+	if assert.NoError(t, err) {
+		assert.True(t, pool.IsOpen())
+		pool.Close()
+	}
+}
+
+func TestClientPoolGetTries(t *testing.T) {
+	zl, ok := logs.GetLogger().(*zlog.ZeroLogger)
+	if !assert.True(t, ok) {
+		return
+	}
+	var buf bytes.Buffer
+	saved := zl.Logger
+	logger := zerolog.New(&buf).Level(zerolog.ErrorLevel)
+	zl.Logger = &logger
+	defer func() { zl.Logger = saved }()
+
+	for retries, tries := range map[uint8]int{0: 1, 1: 1, 3: 3} {
+		buf.Reset()
+
+		pool := &ClientPool{
+			getTimeout:    time.Second,
+			getMaxRetries: retries,
+			borrowed:      make(borrowings),
+			isOpen:        false,
+		}
+		_, err := pool.Get()
+		if assert.Error(t, err) {
+			assert.Contains(t, err.Error(), fmt.Sprintf("after %d tries", tries))
+		}
+		assert.Equal(t, tries, strings.Count(buf.String(),
+			"failed to get a client"), "GetMaxRetries %d", retries)
+	}
+}
+
+func TestClientPoolBalance(t *testing.T) {
+	// The spread of operation counts between clients after many Get/Return
+	// cycles, each of which performs one operation.
+	spread := func(balance bool) uint64 {
+		pool := &ClientPool{
+			getTimeout:          time.Second,
+			getMaxRetries:       1,
+			maxClientRuntime:    time.Hour,
+			maxClientOperations: 1000,
+			balance:             balance,
+			isOpen:              true,
+			maxSize:             4,
+		}
+		for i := 0; i < 4; i++ {
+			pool.push(&Client{isRunning: true, startTime: time.Now()})
+			pool.numClients++
+		}
+
+		for i := 0; i < 100; i++ {
+			client, err := pool.Get()
+			assert.NoError(t, err)
+			client.numOps++
+			assert.NoError(t, pool.Return(client))
+		}
+		assert.Equal(t, uint8(4), pool.size())
+
+		min, max := pool.clients[0].numOps, pool.clients[0].numOps
+		for _, c := range pool.clients {
+			if c.numOps < min {
+				min = c.numOps
+			}
+			if c.numOps > max {
+				max = c.numOps
+			}
+		}
+		return max - min
+	}
+
+	assert.Equal(t, uint64(100), spread(false))
+	assert.LessOrEqual(t, spread(true), uint64(1))
+}
+
+func TestDataObjectConcurrentRead(t *testing.T) {
+	avu := AVU{Attr: "a", Value: "b"}
+	obj := NewDataObject(nil, "/testZone/x")
+	obj.IChecksum = "1181c1834012245d785120e3505ed169"
+	obj.ISize = 100
+	obj.IAVUs = []AVU{avu}
+	obj.IReplicates = []Replicate{{Checksum: obj.IChecksum, Valid: true}}
+
+	// Run with the race detector to check that the read accessors do not
+	// modify the data object
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				assert.Equal(t, "1181c1834012245d785120e3505ed169", obj.Checksum())
+				assert.Equal(t, uint64(100), obj.Size())
+				assert.Equal(t, []AVU{avu}, obj.Metadata())
+				assert.True(t, obj.HasMetadatum(avu))
+				assert.Len(t, obj.ValidReplicates(), 1)
+				assert.Equal(t, "/testZone/x", obj.RodsPath())
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestClientPoolLeak(t *testing.T) {
+	zl, ok := logs.GetLogger().(*zlog.ZeroLogger)
+	if !assert.True(t, ok) {
+		return
+	}
+	var buf bytes.Buffer
+	saved := zl.Logger
+	logger := zerolog.New(&buf).Level(zerolog.WarnLevel)
+	zl.Logger = &logger
+	defer func() { zl.Logger = saved }()
+
+	pool := &ClientPool{
+		getTimeout:    time.Second,
+		getMaxRetries: 1,
+		leakTimeout:   time.Millisecond,
+		borrowed:      make(borrowings),
+		isOpen:        true,
+		maxSize:       2,
+	}
+	for i := 0; i < 2; i++ {
+		pool.push(&Client{isRunning: true})
+		pool.numClients++
+	}
+
+	returned, err := pool.Get()
+	assert.NoError(t, err)
+	_, err = pool.Get() // Never returned
+	assert.NoError(t, err)
+	assert.NoError(t, pool.Return(returned))
+
+	time.Sleep(5 * time.Millisecond)
+
+	pool.Lock()
+	pool.reportLeaks(logs.GetLogger())
+	pool.Unlock()
+
+	assert.Equal(t, 1, strings.Count(buf.String(),
+		"client has not been returned to the pool"))
+	assert.Contains(t, buf.String(), "TestClientPoolLeak")
+
+	// A leaked client is reported only once
+	buf.Reset()
+	pool.Lock()
+	pool.reportLeaks(logs.GetLogger())
+	pool.Unlock()
+	assert.Empty(t, buf.String())
+}
+
+func TestPipeline(t *testing.T) {
+	listResponse := func(id int, name string) string {
+		return fmt.Sprintf(`{"operation":"list","arguments":{},"id":%d,`+
+			`"target":{"collection":"/testZone","data_object":"%s"},`+
+			`"result":{"single":{"collection":"/testZone","data_object":"%s"}}}`,
+			id, name, name)
+	}
+
+	// Responses out of order, including an error
+	client := newRespondingClient(
+		listResponse(2, "b"),
+		`{"operation":"list","arguments":{},"id":3,`+
+			`"target":{"collection":"/testZone","data_object":"c"},`+
+			`"error":{"message":"no such item","code":-310000}}`,
+		listResponse(1, "a"))
+
+	var ops []Operation
+	for _, name := range []string{"a", "b", "c"} {
+		ops = append(ops, Operation{Operation: LIST,
+			Target: RodsItem{IPath: "/testZone", IName: name}})
+	}
+
+	results, err := client.Pipeline(ops)
+	if assert.NoError(t, err) && assert.Len(t, results, 3) {
+		for i, name := range []string{"a", "b"} {
+			assert.NoError(t, results[i].Err)
+			if assert.Len(t, results[i].Items, 1) {
+				assert.Equal(t, name, results[i].Items[0].IName)
+			}
+		}
+		assert.True(t, IsRodsError(results[2].Err))
+	}
+
+	for i := uint64(1); i <= 3; i++ {
+		envelope := &Envelope{}
+		assert.NoError(t, json.Unmarshal(<-client.in, envelope))
+		assert.Equal(t, i, envelope.ID)
+	}
+
+	// Responses without IDs are matched in order
+	client = newRespondingClient(listResponse(0, "a"), listResponse(0, "b"))
+	client.SetPipelineDepth(1)
+
+	results, err = client.Pipeline(ops[:2])
+	if assert.NoError(t, err) && assert.Len(t, results, 2) {
+		assert.Equal(t, "a", results[0].Items[0].IName)
+		assert.Equal(t, "b", results[1].Items[0].IName)
+	}
+
+	// An unknown ID is a protocol error
+	client = newRespondingClient(listResponse(99, "a"))
+	_, err = client.Pipeline(ops[:1])
+	assert.True(t, IsProtocolError(err))
+}
+
+func benchmarkList(b *testing.B, pipelined bool) {
+	client, err := FindAndStart("--unbuffered")
+	if err != nil {
+		b.Skip(err)
+	}
+	defer client.StopIgnoreError()
+
+	ops := make([]Operation, 100)
+	for i := range ops {
+		ops[i] = Operation{Operation: LIST, Target: RodsItem{IPath: "/testZone"}}
+	}
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if pipelined {
+			if _, err = client.Pipeline(ops); err != nil {
+				b.Fatal(err)
+			}
+			continue
+		}
+		for _, op := range ops {
+			if _, err = client.List(op.Args, op.Target); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkListSequential(b *testing.B) {
+	benchmarkList(b, false)
+}
+
+func BenchmarkListPipelined(b *testing.B) {
+	benchmarkList(b, true)
+}
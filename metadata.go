@@ -23,6 +23,7 @@ package extendo
 import (
 	"fmt"
 	"os/user"
+	"strings"
 	"time"
 
 	dcterms "github.com/wtsi-npg/extendo/v2/dublincore"
@@ -44,6 +45,31 @@ func MakeAVU(attr string, value string, units ...string) AVU {
 	return AVU{Attr: attr, Value: value, Units: unit}
 }
 
+// AVUsFromMap returns a sorted slice of AVUs, one for each key and value of
+// the map argument.
+func AVUsFromMap(m map[string]string) []AVU {
+	var avus []AVU
+	for attr, value := range m {
+		avus = append(avus, AVU{Attr: attr, Value: value})
+	}
+
+	SortAVUs(avus)
+	return avus
+}
+
+// AVUsFromMultiMap returns a sorted slice of AVUs, one for each value of each
+// key of the map argument. Duplicate values for a key are included only once.
+func AVUsFromMultiMap(m map[string][]string) []AVU {
+	var avus []AVU
+	for attr, values := range m {
+		for _, value := range values {
+			avus = append(avus, AVU{Attr: attr, Value: value})
+		}
+	}
+
+	return UniqAVUs(avus)
+}
+
 // MakeCreationMetadata returns the standard metadata to be added to a newly
 // created data object. The AVUs describe:
 //
@@ -72,15 +98,32 @@ func MakeCreationMetadata(checksum string) []AVU {
 	}
 }
 
-// SearchAVU returns true if avu is found in the slice of AVUs.
+// provenanceTimeLayout is a fixed-width UTC time layout, with nanoseconds, so
+// that times formatted with it sort lexically in time order.
+const provenanceTimeLayout = "2006-01-02T15:04:05.000000000Z"
+
+// MakeProvenanceAVU returns a Dublin Core provenance AVU recording that a
+// processing step was carried out at the time when, with a value describing
+// it e.g. the software version used. The AVU value has the form
+// "<time> <step>: <value>", where the time is UTC in the fixed-width format
+// "2006-01-02T15:04:05.000000000Z" (RFC3339 with nanoseconds, always given),
+// so that AVUs for repeated steps are distinct and their values sort
+// lexically in time order.
+func MakeProvenanceAVU(step string, value string, when time.Time) AVU {
+	return MakeAVU(dcterms.Provenance, fmt.Sprintf("%s %s: %s",
+		when.UTC().Format(provenanceTimeLayout), step, value))
+}
+
+// SearchAVU returns true if avu is found in the slice of AVUs. As for all the
+// AVU set operations, AVUs are compared without their query Operator.
 func SearchAVU(avu AVU, avus []AVU) bool {
 	m := make(map[AVU]struct{})
 
 	for _, avu := range avus {
-		m[avu] = struct{}{}
+		m[avu.key()] = struct{}{}
 	}
 
-	_, ok := m[avu]
+	_, ok := m[avu.key()]
 	return ok
 }
 
@@ -101,12 +144,12 @@ func SetIntersectAVUs(x []AVU, y []AVU) []AVU {
 	mx := make(map[AVU]struct{})
 
 	for _, avu := range x {
-		mx[avu] = struct{}{}
+		mx[avu.key()] = struct{}{}
 	}
 
 	var intersection []AVU
 	for _, avu := range y {
-		if _, ok := mx[avu]; ok {
+		if _, ok := mx[avu.key()]; ok {
 			intersection = append(intersection, avu)
 		}
 	}
@@ -122,14 +165,14 @@ func SetUnionAVUs(x []AVU, y []AVU) []AVU {
 
 	var union []AVU
 	for _, avu := range x {
-		if _, ok := mx[avu]; !ok {
-			mx[avu] = struct{}{}
+		if _, ok := mx[avu.key()]; !ok {
+			mx[avu.key()] = struct{}{}
 			union = append(union, avu)
 		}
 	}
 
 	for _, avu := range y {
-		if _, ok := mx[avu]; !ok {
+		if _, ok := mx[avu.key()]; !ok {
 			union = append(union, avu)
 		}
 	}
@@ -144,12 +187,12 @@ func SetDiffAVUs(x []AVU, y []AVU) []AVU {
 	my := make(map[AVU]struct{})
 
 	for _, avu := range y {
-		my[avu] = struct{}{}
+		my[avu.key()] = struct{}{}
 	}
 
 	var diff []AVU
 	for _, avu := range x {
-		if _, ok := my[avu]; !ok {
+		if _, ok := my[avu.key()]; !ok {
 			diff = append(diff, avu)
 		}
 	}
@@ -161,16 +204,68 @@ func SetDiffAVUs(x []AVU, y []AVU) []AVU {
 // UniqAVUs returns a newly allocated, sorted slice of AVUs containing no
 // duplicates.
 func UniqAVUs(avus []AVU) []AVU {
-	m := make(map[AVU]struct{})
+	m := make(map[AVU]AVU)
 	for _, avu := range avus {
-		m[avu] = struct{}{}
+		if _, ok := m[avu.key()]; !ok {
+			m[avu.key()] = avu
+		}
 	}
 
 	var uniq []AVU
-	for avu := range m {
+	for _, avu := range m {
 		uniq = append(uniq, avu)
 	}
 
 	SortAVUs(uniq)
 	return uniq
 }
+
+// UniqAVUsStable returns a newly allocated slice of AVUs containing no
+// duplicates. Unlike UniqAVUs, it does not sort the AVUs; the first occurrence
+// of each is retained, in its original order.
+func UniqAVUsStable(avus []AVU) []AVU {
+	m := make(map[AVU]struct{})
+
+	var uniq []AVU
+	for _, avu := range avus {
+		if _, ok := m[avu.key()]; !ok {
+			m[avu.key()] = struct{}{}
+			uniq = append(uniq, avu)
+		}
+	}
+
+	return uniq
+}
+
+// CanonicalAVUs returns a newly allocated, sorted slice of AVUs containing no
+// duplicates, in which leading and trailing whitespace has been trimmed from
+// each attribute, value and units. Metadata that differ only in such
+// whitespace, order or duplication have equal canonical forms. Query operators
+// are discarded because they are not part of stored metadata.
+func CanonicalAVUs(avus []AVU) []AVU {
+	canonical := make([]AVU, 0, len(avus))
+	for _, avu := range avus {
+		canonical = append(canonical, AVU{
+			Attr:  strings.TrimSpace(avu.Attr),
+			Value: strings.TrimSpace(avu.Value),
+			Units: strings.TrimSpace(avu.Units),
+		})
+	}
+
+	return UniqAVUs(canonical)
+}
+
+// NormalizeAVUCase returns a newly allocated slice of AVUs whose attributes
+// have been converted to lower case. Attribute matching in iRODS is
+// case-sensitive, so normalising attributes before adding metadata, and before
+// querying, prevents attributes that differ only in case (e.g. "Sample" and
+// "sample") from fragmenting a dataset. Values and units are unchanged.
+func NormalizeAVUCase(avus []AVU) []AVU {
+	normalized := make([]AVU, 0, len(avus))
+	for _, avu := range avus {
+		avu.Attr = strings.ToLower(avu.Attr)
+		normalized = append(normalized, avu)
+	}
+
+	return normalized
+}
@@ -21,14 +21,28 @@
 package extendo
 
 import (
+	"os"
+	"path"
 	"path/filepath"
+	"reflect"
 	"sort"
 	"strings"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
+	"github.com/pkg/errors"
 	logs "github.com/wtsi-npg/logshim"
 )
 
+var errMetadataConflict = errors.New("metadata conflict")
+
+// IsMetadataConflict returns true if the Cause of the error is that metadata
+// were not as expected by ReplaceMetadataIfUnchanged.
+func IsMetadataConflict(err error) bool {
+	return errors.Cause(err) == errMetadataConflict
+}
+
 // RodsItem represents both collections and data objects in iRODS. It describes
 // the JSON document used by baton and the extendo wrapper and its purpose is to
 // enable extendo to communicate with baton. Extendo includes a higher level API
@@ -36,6 +50,14 @@ import (
 // in preference to RodsItem. A RodsItem is not safe for concurrent use.
 type RodsItem struct {
 	client *Client
+	// Collection ACL inheritance, as last set on this instance. baton does not
+	// report this, so it is a local record only.
+	inherit *bool
+	// Detail fetched from the server by the Fetch methods, to be re-requested
+	// by Refresh.
+	fetched Args
+	// Collection contents were changed by this client after they were fetched.
+	stale bool
 	// Local file name
 	IFile string `json:"file,omitempty"`
 	// Local directory
@@ -79,6 +101,54 @@ func (item *RodsItem) Exists() (bool, error) {
 	return true, nil
 }
 
+// ExistsDetailed returns whether the item exists in iRODS and whether it is
+// accessible to the client's user. If iRODS reports that the user has no
+// permission to access the item, it exists, but is not accessible, and no
+// error is returned. Note that iRODS reports some items that the user may not
+// read as not existing, rather than being inaccessible.
+func (item *RodsItem) ExistsDetailed() (exists bool, accessible bool, err error) {
+	_, err = item.client.ListItem(Args{}, *item)
+	return classifyExists(err)
+}
+
+// classifyExists returns the existence and accessibility of an item, given the
+// error from listing it.
+func classifyExists(err error) (exists bool, accessible bool, rerr error) {
+	if err == nil {
+		return true, true, nil
+	}
+
+	code, cerr := RodsErrorCode(err)
+	switch {
+	case cerr != nil:
+		return false, false, err
+	case code == RodsUserFileDoesNotExist:
+		return false, false, nil
+	case code == RodsCatNoAccessPermission:
+		return true, false, nil
+	default:
+		return false, false, err
+	}
+}
+
+// Remove removes (deletes) the item from iRODS, as for DataObject.Remove if it
+// represents a data object, or Collection.Remove if it represents a
+// collection. A collection must be empty to be removed.
+func (item *RodsItem) Remove() error {
+	var err error
+	switch {
+	case item.IsDataObject():
+		_, err = item.client.RemObj(Args{}, *item)
+	case item.IsCollection():
+		_, err = item.client.RemDir(Args{}, *item)
+	default:
+		err = errors.Errorf("cannot remove '%s' because it is neither a "+
+			"collection nor a data object", item.String())
+	}
+
+	return err
+}
+
 // IsCollection returns true if the item represents a collection.
 func (item *RodsItem) IsCollection() bool {
 	return item.IName == "" && item.IPath != ""
@@ -99,6 +169,99 @@ func (item *RodsItem) IsLocalFile() bool {
 	return item.IFile != ""
 }
 
+// LocalFileExists returns true if the item represents a local file and that
+// file exists (a directory is not a file). This allows a put to be checked
+// before it is sent to iRODS, which would otherwise report a missing file only
+// as error RodsUserFileDoesNotExist.
+func (item *RodsItem) LocalFileExists() (bool, error) {
+	if !item.IsLocalFile() {
+		return false, nil
+	}
+
+	info, err := os.Stat(item.LocalPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return !info.IsDir(), nil
+}
+
+// Validate returns an error if the item is not well-formed as the target of
+// the baton operation op (one of the operation constants e.g. LIST, PUT).
+// Operations on iRODS require a path in iRODS; those on data objects also
+// require a name; those on collections must not have one. A put requires a
+// local path. A metadata query may not have local fields, since they are
+// ignored by iRODS, which would likely be a mistake.
+func (item *RodsItem) Validate(op string) error {
+	switch op {
+	case METAQUERY:
+		if item.IFile != "" {
+			return errors.Errorf("%s target must not set IFile: %+v", op, item)
+		}
+		if item.IDirectory != "" {
+			return errors.Errorf("%s target must not set IDirectory: %+v",
+				op, item)
+		}
+		return nil
+	case CHMOD, CHECKSUM, GET, LIST, METAMOD, MKDIR, MOVE, PUT, REMOVE, RMDIR:
+		if item.IPath == "" {
+			return errors.Errorf("%s target must set IPath: %+v", op, item)
+		}
+		if leavesZone(item.IPath) {
+			return errors.Errorf("%s target path '%s' leaves its zone",
+				op, item.IPath)
+		}
+	default:
+		return errors.Errorf("invalid operation '%s'", op)
+	}
+
+	switch op {
+	case CHECKSUM, GET, REMOVE:
+		if item.IName == "" {
+			return errors.Errorf("%s target must set IName: %+v", op, item)
+		}
+	case MKDIR, RMDIR:
+		if item.IName != "" {
+			return errors.Errorf("%s target must not set IName: %+v", op, item)
+		}
+	case PUT:
+		if item.IDirectory == "" && item.IFile == "" {
+			return errors.Errorf("%s target must set IDirectory or IFile: %+v",
+				op, item)
+		}
+	}
+
+	return nil
+}
+
+// leavesZone returns true if p is an absolute iRODS path whose ".." elements go
+// above its leading zone collection, so that cleaning it would give a path in
+// a different zone, or the root.
+func leavesZone(p string) bool {
+	if !path.IsAbs(p) {
+		return false
+	}
+
+	depth := 0
+	for _, elt := range strings.Split(p, "/") {
+		switch elt {
+		case "", ".":
+		case "..":
+			depth--
+			if depth < 1 {
+				return true
+			}
+		default:
+			depth++
+		}
+	}
+
+	return false
+}
+
 // RodsPath returns the absolute, cleaned path of the item in iRODS, or the
 // empty string.
 func (item *RodsItem) RodsPath() (s string) {
@@ -113,6 +276,44 @@ func (item *RodsItem) RodsPath() (s string) {
 	return s
 }
 
+// RelativeRodsPath returns the path of target relative to base, where both are
+// absolute iRODS paths, such that joining base and the result gives target.
+// A target outside base is reached using ".." elements. iRODS paths always use
+// "/" as a separator, so unlike filepath.Rel, this is independent of the local
+// operating system.
+func RelativeRodsPath(base string, target string) (string, error) {
+	if !path.IsAbs(base) || !path.IsAbs(target) {
+		return "", errors.Errorf("cannot make '%s' relative to '%s': both "+
+			"must be absolute iRODS paths", target, base)
+	}
+
+	splitPath := func(p string) []string {
+		p = path.Clean(p)
+		if p == "/" {
+			return nil
+		}
+		return strings.Split(p[1:], "/")
+	}
+
+	baseElts, targetElts := splitPath(base), splitPath(target)
+
+	i := 0
+	for i < len(baseElts) && i < len(targetElts) && baseElts[i] == targetElts[i] {
+		i++
+	}
+
+	var rel []string
+	for j := i; j < len(baseElts); j++ {
+		rel = append(rel, "..")
+	}
+	rel = append(rel, targetElts[i:]...)
+
+	if len(rel) == 0 {
+		return ".", nil
+	}
+	return path.Join(rel...), nil
+}
+
 // LocalPath returns the absolute, cleaned local path of the item, or an
 // empty string.
 func (item *RodsItem) LocalPath() (s string) {
@@ -145,16 +346,113 @@ func (item *RodsItem) String() (s string) {
 	return s
 }
 
+// Sync re-lists the item with the detail requested by args and replaces all of
+// its cached remote fields (checksum, size, ACLs, AVUs, contents, replicates
+// and timestamps) in a single call. Fields not requested by args are cleared,
+// so that the cache is a consistent snapshot of the server state. Local file
+// fields are not changed.
+func (item *RodsItem) Sync(args Args) error {
+	it, err := item.client.ListItem(args, *item)
+	if err != nil {
+		return err
+	}
+
+	item.IChecksum = it.IChecksum
+	item.ISize = it.ISize
+	item.IACLs = it.IACLs
+	item.IAVUs = it.IAVUs
+	item.IContents = it.IContents
+	item.IReplicates = it.IReplicates
+	item.ITimestamps = it.ITimestamps
+	item.fetched = args
+	item.stale = false
+
+	return nil
+}
+
+// Refresh re-lists the item with only the detail that was previously fetched
+// (by FetchACLs, FetchMetadata, FetchChecksum, FetchContents etc., or by Sync)
+// and replaces those cached fields. Other cached fields are not changed. This
+// avoids fetching detail that the caller has not used.
+func (item *RodsItem) Refresh() error {
+	args := item.fetched
+	recurse := args.Recurse
+	if recurse {
+		// Recursive contents are listed separately, below
+		args.Recurse = false
+		args.Contents = false
+	}
+
+	it, err := item.client.ListItem(args, *item)
+	if err != nil {
+		return err
+	}
+
+	if args.Checksum {
+		item.IChecksum = it.IChecksum
+	}
+	if args.Size {
+		item.ISize = it.ISize
+	}
+	if args.ACL {
+		item.IACLs = it.IACLs
+	}
+	if args.AVU {
+		item.IAVUs = it.IAVUs
+	}
+	if args.Contents {
+		item.IContents = it.IContents
+		item.stale = false
+	}
+	if args.Replicate {
+		item.IReplicates = it.IReplicates
+	}
+	if args.Timestamp {
+		item.ITimestamps = it.ITimestamps
+	}
+
+	if recurse {
+		items, err := item.client.List(Args{Contents: true, Recurse: true}, *item)
+		if err != nil {
+			return err
+		}
+		item.IContents = items
+		item.stale = false
+	}
+
+	return nil
+}
+
+// recordFetch adds the detail requested by args to that re-requested by
+// Refresh. Fetching contents makes them current.
+func (item *RodsItem) recordFetch(args Args) {
+	if args.Contents {
+		item.stale = false
+	}
+
+	f := &item.fetched
+	f.ACL = f.ACL || args.ACL
+	f.AVU = f.AVU || args.AVU
+	f.Checksum = f.Checksum || args.Checksum
+	f.Contents = f.Contents || args.Contents
+	f.Recurse = f.Recurse || args.Recurse
+	f.Replicate = f.Replicate || args.Replicate
+	f.Size = f.Size || args.Size
+	f.Timestamp = f.Timestamp || args.Timestamp
+}
+
 func (item *RodsItem) ACLs() []ACL {
 	return item.IACLs
 }
 
 func (item *RodsItem) FetchACLs() ([]ACL, error) {
-	it, err := item.client.ListItem(Args{ACL: true}, *item)
+	args := Args{ACL: true}
+	it, err := item.client.ListItem(args, *item)
 	if err != nil {
 		return []ACL{}, err
 	}
 	item.IACLs = it.IACLs
+	item.recordFetch(args)
 
 	return item.IACLs, err
 }
@@ -177,26 +475,22 @@ func (item *RodsItem) Metadata() []AVU {
 }
 
 // HasMetadatum returns true if the RodsItem has the argument AVU in its
-// metadata.
+// metadata. The AVU units must match, including when either is empty.
 func (item *RodsItem) HasMetadatum(avu AVU) bool {
-	for _, a := range item.IAVUs {
-		if a == avu {
-			return true
-		}
-	}
-	return false
+	return SearchAVU(item.client.normaliseAVUs([]AVU{avu})[0], item.IAVUs)
 }
 
 // HasSomeMetadata returns true if the RodsItem has at least one of the argument
 // AVUs in its metadata.
 func (item *RodsItem) HasSomeMetadata(avus []AVU) bool {
+	avus = item.client.normaliseAVUs(avus)
 	lookup := make(map[AVU]bool)
 	for _, avu := range item.IAVUs {
-		lookup[avu] = true
+		lookup[avu.key()] = true
 	}
 
 	for _, avu := range avus {
-		if lookup[avu] {
+		if lookup[avu.key()] {
 			return true
 		}
 	}
@@ -207,13 +501,14 @@ func (item *RodsItem) HasSomeMetadata(avus []AVU) bool {
 // HasAllMetadata returns true if the RodsItem has at has every one of the
 // argument AVUs in its metadata.
 func (item *RodsItem) HasAllMetadata(avus []AVU) bool {
+	avus = item.client.normaliseAVUs(avus)
 	lookup := make(map[AVU]bool)
 	for _, avu := range item.IAVUs {
-		lookup[avu] = true
+		lookup[avu.key()] = true
 	}
 
 	for _, avu := range avus {
-		if !lookup[avu] {
+		if !lookup[avu.key()] {
 			return false
 		}
 	}
@@ -223,11 +518,13 @@ func (item *RodsItem) HasAllMetadata(avus []AVU) bool {
 
 // FetchMetadata fetches and returns any metadata AVUs on the RodsItem.
 func (item *RodsItem) FetchMetadata() ([]AVU, error) {
-	it, err := item.client.ListItem(Args{AVU: true}, *item)
+	args := Args{AVU: true}
+	it, err := item.client.ListItem(args, *item)
 	if err != nil {
 		return []AVU{}, err
 	}
 	item.IAVUs = it.IAVUs
+	item.recordFetch(args)
 
 	return item.IAVUs, err
 }
@@ -236,6 +533,7 @@ func (item *RodsItem) FetchMetadata() ([]AVU, error) {
 // are supplied. The add operation is idempotent (adding an AVU that is already
 // present does return an error).
 func (item *RodsItem) AddMetadata(avus []AVU) error {
+	avus = item.client.normaliseAVUs(avus)
 	currentAVUs, err := item.FetchMetadata()
 	if err != nil {
 		return err
@@ -255,10 +553,18 @@ func (item *RodsItem) AddMetadata(avus []AVU) error {
 	return err
 }
 
+// AppendProvenance adds to the RodsItem a provenance AVU recording that a
+// processing step was carried out now, as made by MakeProvenanceAVU. Any
+// provenance AVUs from earlier steps are retained.
+func (item *RodsItem) AppendProvenance(step string, value string) error {
+	return item.AddMetadata([]AVU{MakeProvenanceAVU(step, value, time.Now())})
+}
+
 // RemoveMetadata removes each argument AVU from the RodsItem, in the order
 // that they are supplied. The remove operation is idempotent (removing an AVU
 // that is not present does not return an error).
 func (item *RodsItem) RemoveMetadata(avus []AVU) error {
+	avus = item.client.normaliseAVUs(avus)
 	currentAVUs, err := item.FetchMetadata()
 	if err != nil {
 		return err
@@ -277,25 +583,106 @@ func (item *RodsItem) RemoveMetadata(avus []AVU) error {
 
 // ReplaceMetadata removes from a RodsItem any existing AVUs sharing an
 // attribute with the argument AVUs and then adds to the RodsItem the argument
-// AVUs.
+// AVUs. The locally cached AVUs are sorted afterwards, so the order of the
+// argument AVUs is not preserved; see ReplaceMetadataOrdered.
 func (item *RodsItem) ReplaceMetadata(avus []AVU) error {
+	avus = item.client.normaliseAVUs(avus)
+	currentAVUs, err := item.FetchMetadata()
+	if err != nil {
+		return err
+	}
+
+	return item.replaceMetadata(currentAVUs, avus)
+}
+
+// ReplaceMetadataOrdered replaces metadata as for ReplaceMetadata, but
+// preserves the order of the argument AVUs, for attributes whose values are
+// ordered e.g. ordered tags. All existing AVUs sharing an attribute with the
+// argument AVUs are removed, including any also present in the argument AVUs,
+// and then the argument AVUs are added in the order supplied, omitting any
+// duplicates. The locally cached AVUs are those of the other attributes,
+// followed by the argument AVUs, in order.
+//
+// iRODS does not guarantee the order in which it reports AVUs, although it
+// usually reports them in the order that they were added. To see that order
+// when fetching metadata, the client must also have sorting disabled (see
+// Client.SetSortResults).
+func (item *RodsItem) ReplaceMetadataOrdered(avus []AVU) error {
+	avus = item.client.normaliseAVUs(avus)
+	currentAVUs, err := item.FetchMetadata()
+	if err != nil {
+		return err
+	}
 
-	// Attributes whose AVUs are to be replaced
 	repAttrs := make(map[string]struct{})
 	for _, avu := range avus {
 		repAttrs[avu.Attr] = struct{}{}
 	}
 
-	currentAVUs, err := item.FetchMetadata()
+	var toRemove, others []AVU
+	for _, avu := range currentAVUs {
+		if _, ok := repAttrs[avu.Attr]; ok {
+			toRemove = append(toRemove, avu)
+		} else {
+			others = append(others, avu)
+		}
+	}
+
+	if len(toRemove) > 0 {
+		rem := CopyRodsItem(*item)
+		rem.IAVUs = toRemove
+		if _, err = item.client.MetaRem(Args{}, rem); err != nil {
+			return err
+		}
+	}
+
+	toAdd := UniqAVUsStable(avus)
+	if len(toAdd) > 0 {
+		add := CopyRodsItem(*item)
+		add.IAVUs = toAdd
+		if _, err = item.client.MetaAdd(Args{}, add); err != nil {
+			return err
+		}
+	}
+
+	item.IAVUs = append(others, toAdd...)
+
+	return nil
+}
+
+// CompareMetadata returns the AVUs that ReplaceMetadata would add to and
+// remove from the item in order to replace its metadata with the desired
+// AVUs, without making any changes. The item's current metadata are fetched
+// from the server for the comparison, as ReplaceMetadata does; any metadata
+// cached in the item are neither used nor updated.
+func CompareMetadata(item RodsItem, desired []AVU) (toAdd []AVU,
+	toRemove []AVU, err error) {
+	desired = item.client.normaliseAVUs(desired)
+	it, err := item.client.ListItem(Args{AVU: true}, item)
 	if err != nil {
-		return err
+		return nil, nil, err
+	}
+
+	toAdd, _, toRemove = replaceDelta(it.IAVUs, desired)
+	return toAdd, toRemove, nil
+}
+
+// replaceDelta returns the AVUs to add, to keep and to remove in order to
+// replace the current AVUs with the argument AVUs. Current AVUs sharing an
+// attribute with any argument AVU are removed, unless they are also argument
+// AVUs, in which case they are kept.
+func replaceDelta(currentAVUs []AVU, avus []AVU) (toAdd []AVU, toKeep []AVU,
+	toRemove []AVU) {
+	// Attributes whose AVUs are to be replaced
+	repAttrs := make(map[string]struct{})
+	for _, avu := range avus {
+		repAttrs[avu.Attr] = struct{}{}
 	}
 
 	// These are in the both the existing and replacement sets. Avoid removing
 	// them.
-	toKeep := SetIntersectAVUs(avus, currentAVUs)
+	toKeep = SetIntersectAVUs(avus, currentAVUs)
 
-	var toRemove []AVU
 	for _, avu := range currentAVUs {
 		if _, ok := repAttrs[avu.Attr]; ok {
 			if !SearchAVU(avu, toKeep) {
@@ -304,7 +691,16 @@ func (item *RodsItem) ReplaceMetadata(avus []AVU) error {
 		}
 	}
 
-	toAdd := SetDiffAVUs(avus, toKeep)
+	toAdd = SetDiffAVUs(avus, toKeep)
+
+	return toAdd, toKeep, toRemove
+}
+
+// replaceMetadata is ReplaceMetadata, given the current AVUs of the item. This
+// requires at most two metamod operations because baton applies a single
+// operation, add or rem, to all the AVUs of a metamod request.
+func (item *RodsItem) replaceMetadata(currentAVUs []AVU, avus []AVU) error {
+	toAdd, toKeep, toRemove := replaceDelta(currentAVUs, avus)
 
 	rem := CopyRodsItem(*item)
 	rem.IAVUs = toRemove
@@ -343,12 +739,71 @@ func (item *RodsItem) ReplaceMetadata(avus []AVU) error {
 
 	item.IAVUs = final
 
-	return err
+	return nil
+}
+
+// ReplaceMetadataIfUnchanged replaces all the metadata of the RodsItem with the
+// desired AVUs, provided that its current metadata are the expected AVUs (in
+// any order). If they are not, no changes are made and an error is returned
+// for which IsMetadataConflict is true. This gives compare-and-swap semantics
+// to writers using the same protocol, however, iRODS has no transactions for
+// metadata, so a very short window remains between comparison and change.
+func (item *RodsItem) ReplaceMetadataIfUnchanged(expected []AVU, desired []AVU) error {
+	expected = item.client.normaliseAVUs(expected)
+	desired = item.client.normaliseAVUs(desired)
+	currentAVUs, err := item.FetchMetadata()
+	if err != nil {
+		return err
+	}
+
+	current := UniqAVUs(currentAVUs)
+	if !reflect.DeepEqual(current, UniqAVUs(expected)) {
+		return errors.Wrapf(errMetadataConflict, "metadata of '%s' were "+
+			"changed: expected %v but found %v", item.String(), expected, current)
+	}
+
+	toRemove := SetDiffAVUs(current, desired)
+	toAdd := SetDiffAVUs(desired, current)
+
+	if len(toRemove) > 0 {
+		rem := CopyRodsItem(*item)
+		rem.IAVUs = toRemove
+		if _, err := item.client.MetaRem(Args{}, rem); err != nil {
+			return err
+		}
+	}
+
+	if len(toAdd) > 0 {
+		add := CopyRodsItem(*item)
+		add.IAVUs = toAdd
+		if _, err := item.client.MetaAdd(Args{}, add); err != nil {
+			return err
+		}
+	}
+
+	item.IAVUs = UniqAVUs(desired)
+
+	return nil
+}
+
+// WithClient associates the item, and any cached contents, with a client and
+// returns the item. Items unmarshalled from JSON have no client, so this is
+// required before they can perform any operations.
+func (item *RodsItem) WithClient(client *Client) *RodsItem {
+	item.client = client
+	for i := range item.IContents {
+		item.IContents[i].client = client
+	}
+
+	return item
 }
 
 func CopyRodsItem(item RodsItem) RodsItem {
 	return RodsItem{
 		client:      item.client,
+		inherit:     item.inherit,
+		fetched:     item.fetched,
+		stale:       item.stale,
 		IFile:       item.IFile,
 		IDirectory:  item.IDirectory,
 		IPath:       item.IPath,
@@ -397,16 +852,92 @@ type ACL struct {
 	Zone string `json:"zone"`
 }
 
-// SortACLs sorts acls by Zone, then Owner and finally, Level.
+// The iRODS access levels, in order of increasing permission.
+const (
+	ACLNull  = "null"
+	ACLRead  = "read"
+	ACLWrite = "write"
+	ACLOwn   = "own"
+)
+
+// aclLevels are the iRODS access levels, in order of increasing permission.
+var aclLevels = []string{ACLNull, ACLRead, ACLWrite, ACLOwn}
+
+// aclLevelUnknown is the rank of any access level not in aclLevels.
+var aclLevelUnknown = len(aclLevels)
+
+// ACLLevelRank returns the rank of an iRODS access level in the order
+// null < read < write < own, from 0 for null. Any other level, including the
+// inheritance pseudo levels, ranks after all of these.
+func ACLLevelRank(level string) int {
+	for i, l := range aclLevels {
+		if l == level {
+			return i
+		}
+	}
+
+	return aclLevelUnknown
+}
+
+// ACLInherit and ACLNoInherit are the pseudo access levels that iRODS uses to
+// set and unset ACL inheritance on a collection. The ACL owner is ignored.
+const (
+	ACLInherit   = "inherit"
+	ACLNoInherit = "noinherit"
+)
+
+// FilterItemsByACL returns the items on which owner has at least the access
+// level minLevel, given the iRODS ordering of levels: null < read < write <
+// own. The items must have their ACLs fetched. If minLevel is not one of these
+// levels, no items are returned.
+func FilterItemsByACL(items []RodsItem, owner string, minLevel string) []RodsItem {
+	minRank := ACLLevelRank(minLevel)
+	if minRank == aclLevelUnknown {
+		return nil
+	}
+
+	var match []RodsItem
+	for _, item := range items {
+		for _, acl := range item.IACLs {
+			rank := ACLLevelRank(acl.Level)
+			if acl.Owner == owner && rank >= minRank && rank != aclLevelUnknown {
+				match = append(match, item)
+				break
+			}
+		}
+	}
+
+	return match
+}
+
+// SortACLs sorts acls by Zone, then Owner and finally, Level, in the order
+// given by ACLLevelRank. Unknown levels sort last, by name.
 func SortACLs(acls []ACL) {
 	sort.SliceStable(acls, func(i, j int) bool {
-		return acls[i].Zone < acls[j].Zone ||
-			acls[i].Owner < acls[j].Owner ||
-			acls[i].Level < acls[j].Level
+		a, b := acls[i], acls[j]
+		if a.Zone != b.Zone {
+			return a.Zone < b.Zone
+		}
+		if a.Owner != b.Owner {
+			return a.Owner < b.Owner
+		}
+
+		ra, rb := ACLLevelRank(a.Level), ACLLevelRank(b.Level)
+		if ra != rb {
+			return ra < rb
+		}
+		return a.Level < b.Level
 	})
 }
 
 // AVU is an iRODS attribute, value, units triple.
+//
+// As in iRODS, the units are part of the identity of an AVU: an AVU without
+// units (i.e. with empty Units) is distinct from one having the same attribute
+// and value, but with units. An AVU added without units therefore does not
+// match one with units in HasMetadatum or the AVU set operations, nor the
+// reverse. Note that the iRODS server ignores units when matching a metadata
+// query; see Args.MatchUnits.
 type AVU struct {
 	Attr     string `json:"attribute"`       // iRODS attribute name
 	Value    string `json:"value"`           // iRODS attribute value
@@ -451,12 +982,52 @@ func (avu AVU) WithoutNamespace() string {
 	return avu.Attr
 }
 
+// key returns the AVU without its query Operator, for comparison with other
+// AVUs. The Operator is not part of stored metadata, so an AVU made for a query
+// is equal to the stored AVU that it matches by equality.
+func (avu AVU) key() AVU {
+	avu.Operator = ""
+	return avu
+}
+
+// Validate returns an error if the AVU is not suitable for adding to iRODS.
+// iRODS requires that the attribute and value are not empty. All parts must be
+// valid UTF-8 and must not contain control characters (e.g. newline or tab).
+// While these are safely escaped in the JSON sent to baton-do, iRODS metadata
+// queries do not match them reliably.
+func (avu AVU) Validate() error {
+	if avu.Attr == "" {
+		return errors.Errorf("invalid AVU %+v: empty attribute", avu)
+	}
+	if avu.Value == "" {
+		return errors.Errorf("invalid AVU %+v: empty value", avu)
+	}
+
+	for _, part := range []struct{ name, s string }{
+		{"attribute", avu.Attr}, {"value", avu.Value}, {"units", avu.Units}} {
+		if !utf8.ValidString(part.s) {
+			return errors.Errorf("invalid AVU %+v: %s is not valid UTF-8",
+				avu, part.name)
+		}
+		if i := strings.IndexFunc(part.s, unicode.IsControl); i >= 0 {
+			return errors.Errorf("invalid AVU %+v: %s contains control "+
+				"character %q at byte %d", avu, part.name, part.s[i], i)
+		}
+	}
+
+	return nil
+}
+
 // SortAVUs sorts avus by Attr, then Value and finally, Units.
 func SortAVUs(avus []AVU) {
 	sort.SliceStable(avus, func(i, j int) bool {
-		return avus[i].Attr < avus[j].Attr ||
-			avus[i].Value < avus[j].Value ||
-			avus[i].Units < avus[j].Units
+		if avus[i].Attr != avus[j].Attr {
+			return avus[i].Attr < avus[j].Attr
+		}
+		if avus[i].Value != avus[j].Value {
+			return avus[i].Value < avus[j].Value
+		}
+		return avus[i].Units < avus[j].Units
 	})
 }
 
@@ -478,14 +1049,27 @@ type Replicate struct {
 // Checksum and finally, Valid.
 func SortReplicates(reps []Replicate) {
 	sort.SliceStable(reps, func(i, j int) bool {
-		return reps[i].Resource < reps[j].Resource ||
-			reps[i].Location < reps[j].Location ||
-			reps[i].Number < reps[j].Number ||
-			reps[i].Checksum < reps[j].Checksum ||
-			(reps[i].Valid && !reps[j].Valid)
+		if reps[i].Resource != reps[j].Resource {
+			return reps[i].Resource < reps[j].Resource
+		}
+		if reps[i].Location != reps[j].Location {
+			return reps[i].Location < reps[j].Location
+		}
+		if reps[i].Number != reps[j].Number {
+			return reps[i].Number < reps[j].Number
+		}
+		if reps[i].Checksum != reps[j].Checksum {
+			return reps[i].Checksum < reps[j].Checksum
+		}
+		return reps[i].Valid && !reps[j].Valid
 	})
 }
 
+// Timestamp describes when a replicate of a data object was created and last
+// modified. iRODS does not record when data objects are read, so there is no
+// access time; retention policies based on last access cannot be implemented
+// from catalogue timestamps and must instead use e.g. audit logs or metadata
+// maintained by the reading application.
 type Timestamp struct {
 	// Created time of the replicate
 	Created  time.Time `json:"created,omitempty"`